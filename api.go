@@ -0,0 +1,65 @@
+package maltmill
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// version identifies this build of maltmill in the User-Agent header sent
+// with asset downloads and with the GitLab, Gitea and Bitbucket API
+// requests; GitHub API requests go through go-github's own client.
+const version = "dev"
+
+// UpdateFormula loads the formula at path, checks its release host for a
+// newer version, and if one is found, rewrites path in place. It returns
+// whether a new version was written. trackConstraint, if non-empty,
+// overrides any "# maltmill-track: ..." comment in the formula (e.g. with a
+// Maltmillfile entry's track field). bottleMode selects how an existing
+// `bottle do ... end` block is treated on update: "" or "keep" (default)
+// leaves it untouched, "strip" removes it, and "refresh" recomputes its
+// per-target hashes from the new release's assets. matchers overrides the
+// asset-filename matcher used to pick a platform's release asset, keyed
+// "os" or "os_arch" (e.g. "darwin_arm64") and valued as a regex pattern
+// (e.g. a Maltmillfile entry's matchers field); it may be nil.
+func UpdateFormula(path string, tokens map[string]string, trackConstraint, bottleMode string, matchers map[string]string) (updated bool, err error) {
+	fo, err := newFormula(path)
+	if err != nil {
+		return false, err
+	}
+	if trackConstraint != "" {
+		if err := fo.setTrackConstraint(trackConstraint); err != nil {
+			return false, err
+		}
+	}
+	if err := fo.setBottleMode(bottleMode); err != nil {
+		return false, err
+	}
+	for key, pattern := range matchers {
+		if err := fo.setMatcher(key, pattern); err != nil {
+			return false, err
+		}
+	}
+	updated, err = fo.update(tokens)
+	if err != nil || !updated {
+		return updated, err
+	}
+	return true, ioutil.WriteFile(path, []byte(fo.content), 0644)
+}
+
+// CreateFormula creates a new formula for slug (e.g. "owner/repo",
+// "gitlab:owner/repo", or "gitea.example.com/owner/repo@v1.2.3") and writes
+// it to w, or to outFile when one is given. matchers overrides the
+// asset-filename matcher used to pick the formula's release asset, keyed
+// "os" or "os_arch" as in UpdateFormula; a new formula picks a single
+// asset, so only the "darwin_amd64" entry is consulted. It may be nil.
+func CreateFormula(w io.Writer, slug, outFile string, tokens, matchers map[string]string) error {
+	cr := &creator{
+		writer:    w,
+		slug:      slug,
+		overwrite: outFile != "",
+		outFile:   outFile,
+		tokens:    tokens,
+		matchers:  matchers,
+	}
+	return cr.run()
+}
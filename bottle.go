@@ -0,0 +1,176 @@
+package maltmill
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// bottleTarget is one `sha256 cellar: ..., <target>: "<hash>"` entry inside
+// a formula's `bottle do ... end` block, e.g. "arm64_sonoma" or
+// "x86_64_linux".
+type bottleTarget struct {
+	name, cellar, sha256 string
+}
+
+// bottleBlock is the parsed form of a formula's `bottle do ... end` stanza.
+// start/end are byte offsets of the whole block (including the "bottle do"
+// and "end" lines) within formula.content. rootURL/rebuild are carried
+// through verbatim; only target sha256 values are ever rewritten.
+type bottleBlock struct {
+	start, end int
+	rootURL    string
+	rebuild    string
+	targets    []*bottleTarget
+}
+
+var (
+	bottleStartReg   = regexp.MustCompile(`(?m)^\s*bottle do\s*$`)
+	bottleRootReg    = regexp.MustCompile(`(?m)^\s*root_url\s*['"](.*)['"]`)
+	bottleRebuildReg = regexp.MustCompile(`(?m)^\s*rebuild\s+(\d+)\s*$`)
+	bottleShaReg     = regexp.MustCompile(`(?m)^\s*sha256\s+cellar:\s*([^,]+),\s*(\w+):\s*["']([0-9a-f]{64})["']`)
+)
+
+// parseBottleBlock looks for a top-level `bottle do ... end` block in
+// content and parses its root_url/rebuild fields and per-target sha256
+// entries. It returns nil if content has no bottle block.
+//
+// Block boundaries come from findDoEndBlock, the same nesting-aware
+// primitive platform.go uses for on_macos/on_linux/on_arm/on_intel, so a
+// bottle block is located consistently with every other do/end block
+// maltmill parses rather than by its own one-off regex.
+func parseBottleBlock(content string) *bottleBlock {
+	start, bodyStart, bodyEnd, end, ok := findDoEndBlock(content, bottleStartReg)
+	if !ok {
+		return nil
+	}
+	b := &bottleBlock{start: start, end: end}
+	body := content[bodyStart:bodyEnd]
+
+	if m := bottleRootReg.FindStringSubmatch(body); len(m) > 1 {
+		b.rootURL = m[1]
+	}
+	if m := bottleRebuildReg.FindStringSubmatch(body); len(m) > 1 {
+		b.rebuild = m[1]
+	}
+	for _, m := range bottleShaReg.FindAllStringSubmatch(body, -1) {
+		b.targets = append(b.targets, &bottleTarget{
+			name:   m[2],
+			cellar: strings.TrimSpace(m[1]),
+			sha256: m[3],
+		})
+	}
+	return b
+}
+
+// bottleMode controls how formula.update treats an existing `bottle do
+// ... end` block.
+type bottleMode int
+
+const (
+	// bottleKeep leaves an existing bottle block untouched (the default):
+	// its hashes stay pinned to the previous release until rebottled
+	// upstream.
+	bottleKeep bottleMode = iota
+	// bottleStrip removes the bottle block entirely, forcing Homebrew to
+	// build from source on the next install.
+	bottleStrip
+	// bottleRefresh recomputes each target's hash from the release asset
+	// matching that target's platform, via bottleTargetPlatforms.
+	bottleRefresh
+)
+
+// bottleTargetPlatforms maps a Homebrew bottle target name to the (os,
+// arch) whose release asset its hash should be refreshed from.
+var bottleTargetPlatforms = map[string][2]string{
+	"arm64_sonoma":   {"darwin", "arm64"},
+	"arm64_ventura":  {"darwin", "arm64"},
+	"arm64_monterey": {"darwin", "arm64"},
+	"sonoma":         {"darwin", "amd64"},
+	"ventura":        {"darwin", "amd64"},
+	"monterey":       {"darwin", "amd64"},
+	"x86_64_linux":   {"linux", "amd64"},
+}
+
+// parseBottleMode maps a Maltmillfile/CLI bottle mode string ("", "keep",
+// "strip", or "refresh") to a bottleMode.
+func parseBottleMode(mode string) (bottleMode, error) {
+	switch mode {
+	case "", "keep":
+		return bottleKeep, nil
+	case "strip":
+		return bottleStrip, nil
+	case "refresh":
+		return bottleRefresh, nil
+	default:
+		return bottleKeep, errors.Errorf("invalid bottle mode: %s", mode)
+	}
+}
+
+// setBottleMode parses mode ("", "keep", "strip", or "refresh") and sets it
+// as fo's bottleMode, overriding the default of leaving an existing bottle
+// block untouched.
+func (fo *formula) setBottleMode(mode string) error {
+	m, err := parseBottleMode(mode)
+	if err != nil {
+		return err
+	}
+	fo.mode = m
+	return nil
+}
+
+// rewriteBottle applies fo.mode to fo.content's bottle block, if any. It
+// re-locates the block fresh, since any platform block rewrites earlier in
+// updateContent can shift the byte offsets fo.bottle was parsed at. It must
+// run before fo.content is re-parsed into a fresh Document, since stripping
+// or rewriting the block shifts the byte offsets of anything after it.
+func (fo *formula) rewriteBottle() {
+	if fo.bottle == nil {
+		return
+	}
+	bottle := parseBottleBlock(fo.content)
+	if bottle == nil {
+		return
+	}
+
+	switch fo.mode {
+	case bottleStrip:
+		fo.content = fo.content[:bottle.start] + fo.content[bottle.end:]
+	case bottleRefresh:
+		block := fo.content[bottle.start:bottle.end]
+		for _, t := range bottle.targets {
+			plat, ok := bottleTargetPlatforms[t.name]
+			if !ok {
+				continue
+			}
+			newSHA := fo.platformSHA256(plat[0], plat[1])
+			if newSHA == "" {
+				continue
+			}
+			block = replaceBottleTargetSHA256(block, t.name, newSHA)
+		}
+		fo.content = fo.content[:bottle.start] + block + fo.content[bottle.end:]
+	}
+}
+
+// platformSHA256 returns the current sha256 of fo's platform target for
+// (os, arch), or "" if fo has none. A target with no arch (an on_linux or
+// on_macos block with no nested on_arm/on_intel, e.g. the common shape for
+// a Linux bottle) is treated as matching any requested arch for that os,
+// since it is the formula's only asset for that os.
+func (fo *formula) platformSHA256(os, arch string) string {
+	for _, t := range fo.platforms {
+		if t.os == os && (t.arch == arch || t.arch == "") {
+			return t.sha256
+		}
+	}
+	return ""
+}
+
+// replaceBottleTargetSHA256 rewrites target's sha256 value within block,
+// leaving every other target's hash, and root_url/rebuild/cellar, verbatim.
+func replaceBottleTargetSHA256(block, target, newSHA string) string {
+	reg := regexp.MustCompile(`(?m)(^\s*sha256\s+cellar:\s*[^,]+,\s*` + regexp.QuoteMeta(target) + `:\s*["'])[0-9a-f]{64}(["'])`)
+	return reg.ReplaceAllString(block, `${1}`+newSHA+`${2}`)
+}
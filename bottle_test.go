@@ -0,0 +1,161 @@
+package maltmill
+
+import (
+	"strings"
+	"testing"
+)
+
+const testFormulaWithBottle = `class Foo < Formula
+  version '1.0.0'
+  url "https://example.com/foo-1.0.0-darwin-amd64.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+
+  bottle do
+    root_url "https://example.com/bottles"
+    rebuild 1
+    sha256 cellar: :any, arm64_sonoma: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    sha256 cellar: :any, x86_64_linux: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+  end
+
+  def install
+    bin.install "foo"
+  end
+end
+`
+
+func TestParseBottleBlock(t *testing.T) {
+	b := parseBottleBlock(testFormulaWithBottle)
+	if b == nil {
+		t.Fatal("parseBottleBlock() = nil, want a bottle block")
+	}
+	if b.rootURL != "https://example.com/bottles" {
+		t.Errorf("rootURL = %q, want https://example.com/bottles", b.rootURL)
+	}
+	if b.rebuild != "1" {
+		t.Errorf("rebuild = %q, want 1", b.rebuild)
+	}
+	if len(b.targets) != 2 {
+		t.Fatalf("len(targets) = %d, want 2", len(b.targets))
+	}
+	want := map[string]string{
+		"arm64_sonoma": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		"x86_64_linux": "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+	}
+	for _, target := range b.targets {
+		if target.sha256 != want[target.name] {
+			t.Errorf("target[%s].sha256 = %q, want %q", target.name, target.sha256, want[target.name])
+		}
+	}
+}
+
+func TestParseBottleBlockNone(t *testing.T) {
+	if b := parseBottleBlock("class Foo < Formula\nend\n"); b != nil {
+		t.Errorf("parseBottleBlock() = %v, want nil for a formula with no bottle block", b)
+	}
+}
+
+func TestRewriteBottleStrip(t *testing.T) {
+	fo := &formula{
+		content: testFormulaWithBottle,
+		bottle:  parseBottleBlock(testFormulaWithBottle),
+		mode:    bottleStrip,
+	}
+	fo.rewriteBottle()
+
+	if b := parseBottleBlock(fo.content); b != nil {
+		t.Errorf("bottle block still present after strip: %+v", b)
+	}
+	if got := "  def install\n"; !strings.Contains(fo.content, got) {
+		t.Errorf("content lost unrelated lines after strip:\n%s", fo.content)
+	}
+}
+
+func TestRewriteBottleRefresh(t *testing.T) {
+	fo := &formula{
+		content: testFormulaWithBottle,
+		bottle:  parseBottleBlock(testFormulaWithBottle),
+		mode:    bottleRefresh,
+		platforms: []*platformTarget{
+			{os: "darwin", arch: "arm64", sha256: "1111111111111111111111111111111111111111111111111111111111111111"},
+			{os: "linux", arch: "amd64", sha256: "2222222222222222222222222222222222222222222222222222222222222222"},
+		},
+	}
+	fo.rewriteBottle()
+
+	b := parseBottleBlock(fo.content)
+	if b == nil {
+		t.Fatal("parseBottleBlock() = nil after refresh, want the block to survive")
+	}
+	if b.rootURL != "https://example.com/bottles" || b.rebuild != "1" {
+		t.Errorf("root_url/rebuild not preserved: rootURL=%q rebuild=%q", b.rootURL, b.rebuild)
+	}
+	want := map[string]string{
+		"arm64_sonoma": "1111111111111111111111111111111111111111111111111111111111111111",
+		"x86_64_linux": "2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	for _, target := range b.targets {
+		if target.sha256 != want[target.name] {
+			t.Errorf("target[%s].sha256 = %q, want refreshed %q", target.name, target.sha256, want[target.name])
+		}
+	}
+}
+
+// TestRewriteBottleRefreshPlainOnLinux reproduces the normal shape of a
+// Linux bottle: on_macos with nested on_arm/on_intel, but a plain on_linux
+// with no nested arch blocks, which parsePlatformBlocks gives arch "". The
+// x86_64_linux bottle target must still be refreshed from it.
+func TestRewriteBottleRefreshPlainOnLinux(t *testing.T) {
+	content := `class Foo < Formula
+  version '1.0.0'
+
+  on_macos do
+    on_arm do
+      url "https://example.com/foo-1.0.0-darwin-arm64.tar.gz"
+      sha256 "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    end
+    on_intel do
+      url "https://example.com/foo-1.0.0-darwin-amd64.tar.gz"
+      sha256 "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+    end
+  end
+  on_linux do
+    url "https://example.com/foo-1.0.0-linux-amd64.tar.gz"
+    sha256 "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+  end
+
+  bottle do
+    sha256 cellar: :any, arm64_sonoma: "1111111111111111111111111111111111111111111111111111111111111111"
+    sha256 cellar: :any_skip_relocation, x86_64_linux: "2222222222222222222222222222222222222222222222222222222222222222"
+  end
+end
+`
+	platforms := parsePlatformBlocks(content)
+	fo := &formula{
+		content: content,
+		bottle:  parseBottleBlock(content),
+		mode:    bottleRefresh,
+		platforms: []*platformTarget{
+			{os: "darwin", arch: "arm64", sha256: "3333333333333333333333333333333333333333333333333333333333333333"},
+			{os: "linux", arch: platforms[2].arch, sha256: "4444444444444444444444444444444444444444444444444444444444444444"},
+		},
+	}
+	if fo.platforms[1].arch != "" {
+		t.Fatalf("test setup: expected an un-split on_linux leaf with arch \"\", got %q", fo.platforms[1].arch)
+	}
+
+	fo.rewriteBottle()
+
+	b := parseBottleBlock(fo.content)
+	if b == nil {
+		t.Fatal("parseBottleBlock() = nil after refresh, want the block to survive")
+	}
+	want := map[string]string{
+		"arm64_sonoma": "3333333333333333333333333333333333333333333333333333333333333333",
+		"x86_64_linux": "4444444444444444444444444444444444444444444444444444444444444444",
+	}
+	for _, target := range b.targets {
+		if target.sha256 != want[target.name] {
+			t.Errorf("target[%s].sha256 = %q, want refreshed %q (a plain on_linux block must still refresh x86_64_linux)", target.name, target.sha256, want[target.name])
+		}
+	}
+}
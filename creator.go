@@ -1,16 +1,15 @@
 package maltmill
 
 import (
-	"context"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"path"
+	"regexp"
 	"strings"
 	"text/template"
 
 	"github.com/Masterminds/semver"
-	"github.com/google/go-github/github"
 	"github.com/pkg/errors"
 )
 
@@ -19,15 +18,24 @@ type creator struct {
 	slug      string
 	overwrite bool
 	outFile   string
-	ghcli     *github.Client
+	tokens    map[string]string
+	// matchers overrides the asset-filename matcher used to pick the
+	// formula's release asset, keyed "os" or "os_arch" as in
+	// formula.matcherFor; a new formula only ever picks one asset, so only
+	// the "darwin_amd64" entry (if any) applies.
+	matchers map[string]string
+	// provider overrides the releaseProvider run would otherwise construct
+	// from the slug's host via newReleaseProvider. Left nil outside tests,
+	// the same test seam as formula.updateWithProvider.
+	provider releaseProvider
 }
 
 var tmpl = `class {{.CapitalizedName}} < Formula
   version '{{.Version}}'
-  homepage 'https://github.com/{{.Owner}}/{{.Repo}}'
+  homepage 'https://{{.Host}}/{{.Owner}}/{{.Repo}}'
   url "{{.URL}}"
   sha256 '{{.SHA256}}'
-  head 'https://github.com/{{.Owner}}/{{.Repo}}.git'
+  head 'https://{{.Host}}/{{.Owner}}/{{.Repo}}.git'
 
   head do
     depands_on 'go' => :build
@@ -45,14 +53,58 @@ end
 type formulaData struct {
 	Name, CapitalizedName string
 	Version               string
-	Owner, Repo           string
+	Host, Owner, Repo     string
 	SHA256, URL           string
 }
 
 var formulaTmpl = template.Must(template.New("formulaTmpl").Parse(tmpl))
 
+// knownHostPrefixes maps the short provider names accepted in a slug
+// (e.g. "gitlab:owner/repo") to the host they create formulae for.
+var knownHostPrefixes = map[string]string{
+	"github":    "github.com",
+	"gitlab":    "gitlab.com",
+	"gitea":     "gitea.com",
+	"bitbucket": "bitbucket.org",
+}
+
+// parseSlug splits a slug of the form "owner/repo", "gitlab:owner/repo",
+// or "gitea.example.com/owner/repo" into the host it refers to and the
+// remaining "owner/repo[@tag]" portion, defaulting to github.com.
+func parseSlug(slug string) (host, ownerRepo string) {
+	if i := strings.Index(slug, ":"); i >= 0 {
+		prefix, rest := slug[:i], slug[i+1:]
+		if h, ok := knownHostPrefixes[prefix]; ok {
+			return h, rest
+		}
+		return prefix, rest
+	}
+	// A bare domain with no "prefix:" form, e.g. "gitea.example.com/owner/repo":
+	// its first path segment contains a dot, unlike an owner name.
+	if i := strings.Index(slug, "/"); i >= 0 && strings.Contains(slug[:i], ".") {
+		return slug[:i], slug[i+1:]
+	}
+	return "github.com", slug
+}
+
+// assetMatcher resolves cr's asset-filename matcher override for key (e.g.
+// "darwin_amd64"), falling back to defaultMatchers when cr.matchers has no
+// entry for key.
+func (cr *creator) assetMatcher(key string) (*regexp.Regexp, error) {
+	pattern, ok := cr.matchers[key]
+	if !ok {
+		return defaultMatchers[key], nil
+	}
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid matcher for %s", key)
+	}
+	return reg, nil
+}
+
 func (cr *creator) run() error {
-	ownerAndRepo := strings.Split(cr.slug, "/")
+	host, ownerRepo := parseSlug(cr.slug)
+	ownerAndRepo := strings.Split(ownerRepo, "/")
 	if len(ownerAndRepo) != 2 {
 		return errors.Errorf("invalid slug: %s", cr.slug)
 	}
@@ -62,38 +114,36 @@ func (cr *creator) run() error {
 		tag = repoAndVer[1]
 	}
 	nf := &formulaData{
+		Host:            host,
 		Owner:           ownerAndRepo[0],
 		Repo:            repoAndVer[0],
 		Name:            repoAndVer[0],
 		CapitalizedName: strings.Replace(strings.Title(repoAndVer[0]), "-", "", -1),
 	}
-	rele, resp, err := func() (*github.RepositoryRelease, *github.Response, error) {
+	provider := cr.provider
+	if provider == nil {
+		provider = newReleaseProvider(host, cr.tokens[host])
+	}
+	rele, err := func() (*release, error) {
 		if tag == "" {
-			return cr.ghcli.Repositories.GetLatestRelease(context.Background(), nf.Owner, nf.Repo)
+			return provider.GetLatestRelease(nf.Owner, nf.Repo)
 		}
-		return cr.ghcli.Repositories.GetReleaseByTag(context.Background(), nf.Owner, nf.Repo, tag)
+		return provider.GetReleaseByTag(nf.Owner, nf.Repo, tag)
 	}()
 	if err != nil {
 		return errors.Wrapf(err, "create new formula failed")
 	}
-	resp.Body.Close()
 
-	ver, err := semver.NewVersion(rele.GetTagName())
+	ver, err := semver.NewVersion(rele.tagName)
 	if err != nil {
-		return errors.Wrapf(err, "invalid tag name: %s", rele.GetTagName())
+		return errors.Wrapf(err, "invalid tag name: %s", rele.tagName)
 	}
 	nf.Version = fmt.Sprintf("%d.%d.%d", ver.Major(), ver.Minor(), ver.Patch())
-	nf.URL, err = func() (string, error) {
-		for _, asset := range rele.Assets {
-			u := asset.GetBrowserDownloadURL()
-			fname := path.Base(u)
-			if strings.Contains(fname, "amd64") &&
-				strings.Contains(fname, "darwin") {
-				return u, nil
-			}
-		}
-		return "", errors.New("no assets found from latest release")
-	}()
+	matcher, err := cr.assetMatcher("darwin_amd64")
+	if err != nil {
+		return err
+	}
+	nf.URL, err = pickAsset(rele.assets, matcher, "")
 	if err != nil {
 		return err
 	}
@@ -102,6 +152,18 @@ func (cr *creator) run() error {
 		return errors.Wrapf(err, "faild to create new formula")
 	}
 
+	var rendered bytes.Buffer
+	if err := formulaTmpl.Execute(&rendered, nf); err != nil {
+		return err
+	}
+	// Write out doc.String(), not rendered.String(): the template output
+	// goes through the same Document writer formula.update uses. That
+	// writer is lossless, so the file holds exactly the rendered text.
+	doc, err := parseDocument(rendered.String())
+	if err != nil {
+		return err
+	}
+
 	var wtr = cr.writer
 	if cr.overwrite || cr.outFile != "" {
 		fname := cr.outFile
@@ -115,5 +177,6 @@ func (cr *creator) run() error {
 		defer f.Close()
 		wtr = f
 	}
-	return formulaTmpl.Execute(wtr, nf)
+	_, err = io.WriteString(wtr, doc.String())
+	return err
 }
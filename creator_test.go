@@ -0,0 +1,62 @@
+package maltmill
+
+import "testing"
+
+func TestParseSlug(t *testing.T) {
+	tests := []struct {
+		slug          string
+		host          string
+		wantOwnerRepo string
+	}{
+		{"owner/repo", "github.com", "owner/repo"},
+		{"github:owner/repo", "github.com", "owner/repo"},
+		{"gitlab:owner/repo", "gitlab.com", "owner/repo"},
+		{"gitea:owner/repo", "gitea.com", "owner/repo"},
+		{"bitbucket:owner/repo", "bitbucket.org", "owner/repo"},
+		{"gitea.example.com/owner/repo", "gitea.example.com", "owner/repo"},
+		{"git.example.com:owner/repo", "git.example.com", "owner/repo"},
+	}
+
+	for _, tt := range tests {
+		host, ownerRepo := parseSlug(tt.slug)
+		if host != tt.host || ownerRepo != tt.wantOwnerRepo {
+			t.Errorf("parseSlug(%q) = (%q, %q), want (%q, %q)",
+				tt.slug, host, ownerRepo, tt.host, tt.wantOwnerRepo)
+		}
+	}
+}
+
+func TestCreatorAssetMatcherOverride(t *testing.T) {
+	cr := &creator{matchers: map[string]string{"darwin_amd64": `darwin.*amd64\.tar\.gz`}}
+
+	reg, err := cr.assetMatcher("darwin_amd64")
+	if err != nil {
+		t.Fatalf("assetMatcher() error = %v", err)
+	}
+	if !reg.MatchString("foo-darwin-amd64.tar.gz") {
+		t.Errorf("assetMatcher(darwin_amd64) = %q, want it to match foo-darwin-amd64.tar.gz", reg.String())
+	}
+	if reg.MatchString("foo-darwin-amd64.zip") {
+		t.Errorf("assetMatcher(darwin_amd64) = %q, want it not to match foo-darwin-amd64.zip", reg.String())
+	}
+}
+
+func TestCreatorAssetMatcherFallsBackToDefault(t *testing.T) {
+	cr := &creator{}
+
+	reg, err := cr.assetMatcher("darwin_amd64")
+	if err != nil {
+		t.Fatalf("assetMatcher() error = %v", err)
+	}
+	if reg != defaultMatchers["darwin_amd64"] {
+		t.Errorf("assetMatcher(darwin_amd64) = %v, want defaultMatchers[darwin_amd64]", reg)
+	}
+}
+
+func TestCreatorAssetMatcherInvalidPattern(t *testing.T) {
+	cr := &creator{matchers: map[string]string{"darwin_amd64": `(`}}
+
+	if _, err := cr.assetMatcher("darwin_amd64"); err == nil {
+		t.Fatal("assetMatcher() error = nil, want error for invalid regex")
+	}
+}
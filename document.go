@@ -0,0 +1,289 @@
+package maltmill
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Document is a line-aware view of a Ruby formula's source. Unlike a plain
+// regex scan over the whole file, it tracks which lines sit inside a
+// heredoc or a full-line comment, so a "# ... sha256 ..." comment or a
+// `<<~EOS ... EOS` body can't be mistaken for a real `version`/`url`/
+// `sha256` assignment. Reading and writing a field always goes through the
+// single line it was found on, which is what makes Write lossless:
+// everything else in the file — whitespace, quoting, comment placement —
+// is left untouched.
+//
+// PlatformBlocks and BottleBlock expose the on_macos/on_linux/on_arm/
+// on_intel and bottle do...end stanzas through the shared findDoEndBlock
+// primitive below, so platform.go and bottle.go don't each need their own
+// entry point onto a formula's content. Unlike the field accessors, they
+// scan the whole text, heredoc bodies included.
+type Document struct {
+	lines []string
+
+	nameLine, versionLine, urlLine, shaLine int
+
+	// isCode marks, per line, whether it was eligible to match a field at
+	// all — i.e. not a full-line comment or inside a heredoc body. Used by
+	// URLIsTopLevel to check every candidate url/sha256 line, not just the
+	// first one parseDocument kept.
+	isCode []bool
+
+	// trackLine is the line index of the first "# maltmill-track: ..."
+	// comment found outside any heredoc body, or -1 if there is none.
+	// trackPrereleases is whether a "# maltmill-track-prereleases: true"
+	// comment was found the same way. Both are matched against comment
+	// lines directly — unlike isCode, which excludes them — since these
+	// directives only ever live in comments; what must still be excluded is
+	// a heredoc body (e.g. a caveats message) that merely mentions the
+	// directive text without it being a real one.
+	trackLine        int
+	trackPrereleases bool
+}
+
+// heredocStartReg matches the opening of a Ruby heredoc, e.g. `<<~EOS`,
+// `<<-EOS`, or `<<"EOS"`, capturing its terminator.
+var heredocStartReg = regexp.MustCompile(`<<[-~]?["']?(\w+)["']?`)
+
+// parseDocument tokenizes content into lines, classifies each as code,
+// full-line comment, or heredoc body, and locates the name/version/url/
+// sha256 assignments among the code lines.
+func parseDocument(content string) (*Document, error) {
+	lines := strings.Split(content, "\n")
+	doc := &Document{
+		lines:       lines,
+		nameLine:    -1,
+		versionLine: -1,
+		urlLine:     -1,
+		shaLine:     -1,
+		isCode:      make([]bool, len(lines)),
+		trackLine:   -1,
+	}
+
+	inHeredoc := false
+	heredocTerm := ""
+	for i, line := range lines {
+		if inHeredoc {
+			if strings.TrimSpace(line) == heredocTerm {
+				inHeredoc = false
+			}
+			continue
+		}
+		if doc.trackLine < 0 && len(trackReg.FindStringSubmatch(line)) > 1 {
+			doc.trackLine = i
+		}
+		if !doc.trackPrereleases && trackPrereleasesReg.MatchString(line) {
+			doc.trackPrereleases = true
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if m := heredocStartReg.FindStringSubmatch(line); m != nil {
+			heredocTerm = m[1]
+			inHeredoc = true
+		}
+		doc.isCode[i] = true
+
+		if doc.nameLine < 0 && len(nameReg.FindStringSubmatch(line)) > 1 {
+			doc.nameLine = i
+		}
+		if doc.versionLine < 0 && len(verReg.FindStringSubmatch(line)) > 3 {
+			doc.versionLine = i
+		}
+		if doc.urlLine < 0 && len(urlReg.FindStringSubmatch(line)) > 3 {
+			doc.urlLine = i
+		}
+		if doc.shaLine < 0 && len(shaReg.FindStringSubmatch(line)) > 3 {
+			doc.shaLine = i
+		}
+	}
+
+	return doc, nil
+}
+
+// Name returns the formula's `name = "..."` value, or "" if it has none.
+func (d *Document) Name() string { return d.fieldValue(nameReg, d.nameLine, 1) }
+
+// Version returns the formula's `version '...'` value, or "" if none was found.
+func (d *Document) Version() string { return d.fieldValue(verReg, d.versionLine, 2) }
+
+// URL returns the formula's top-level `url "..."` value, or "" if none was found.
+func (d *Document) URL() string { return d.fieldValue(urlReg, d.urlLine, 2) }
+
+// SHA256 returns the formula's top-level `sha256 '...'` value, or "" if none was found.
+func (d *Document) SHA256() string { return d.fieldValue(shaReg, d.shaLine, 2) }
+
+// TrackConstraint returns the semver constraint from d's
+// "# maltmill-track: ..." comment, or "" if it has none. Unlike a raw regex
+// scan over the whole file, this ignores the directive text when it only
+// appears inside a heredoc body (e.g. a caveats message documenting the
+// formula's own update config).
+func (d *Document) TrackConstraint() string { return d.fieldValue(trackReg, d.trackLine, 1) }
+
+// TrackPrereleases reports whether d has a
+// "# maltmill-track-prereleases: true" comment outside any heredoc body.
+func (d *Document) TrackPrereleases() bool { return d.trackPrereleases }
+
+// lineOffset returns the byte offset of the start of d.lines[n] within
+// d.String().
+func (d *Document) lineOffset(n int) int {
+	off := 0
+	for i := 0; i < n; i++ {
+		off += len(d.lines[i]) + 1
+	}
+	return off
+}
+
+// URLIsTopLevel reports whether d has a url or sha256 line outside every
+// block in blocks (e.g. the platformTargets PlatformBlocks returns) — a
+// legacy top-level url/sha256 coexisting with on_macos/on_linux blocks —
+// regardless of whether that line comes before or after the blocks in the
+// file. Checking every candidate line, not just the first url/sha256
+// parseDocument kept, matters because a block can appear earlier in the
+// file than the genuine top-level pair.
+func (d *Document) URLIsTopLevel(blocks []*platformTarget) bool {
+	for i, isCode := range d.isCode {
+		if !isCode {
+			continue
+		}
+		line := d.lines[i]
+		if len(urlReg.FindStringSubmatch(line)) <= 3 && len(shaReg.FindStringSubmatch(line)) <= 3 {
+			continue
+		}
+		off := d.lineOffset(i)
+		inside := false
+		for _, b := range blocks {
+			if off >= b.blockStart && off < b.blockEnd {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Document) fieldValue(reg *regexp.Regexp, line, group int) string {
+	if line < 0 {
+		return ""
+	}
+	m := reg.FindStringSubmatch(d.lines[line])
+	if len(m) <= group {
+		return ""
+	}
+	return m[group]
+}
+
+// SetVersion rewrites the version line in place, preserving its quoting and
+// surrounding whitespace. It is a no-op if Version() found none.
+func (d *Document) SetVersion(v string) { d.setField(verReg, d.versionLine, v) }
+
+// SetURL rewrites the url line in place. It is a no-op if URL() found none.
+func (d *Document) SetURL(v string) { d.setField(urlReg, d.urlLine, v) }
+
+// SetSHA256 rewrites the sha256 line in place. It is a no-op if SHA256() found none.
+func (d *Document) SetSHA256(v string) { d.setField(shaReg, d.shaLine, v) }
+
+func (d *Document) setField(reg *regexp.Regexp, line int, value string) {
+	if line < 0 {
+		return
+	}
+	d.lines[line] = replaceOne(reg, d.lines[line], `${1}`+value+`${3}`)
+}
+
+// String reassembles the document's lines back into a single lossless string.
+func (d *Document) String() string {
+	return strings.Join(d.lines, "\n")
+}
+
+// PlatformBlocks returns one platformTarget per on_macos/on_linux/on_arm/
+// on_intel url+sha256 pair in d, or nil if d has none. It is the Document
+// entry point for the same block-finding platform.go's parsePlatformBlocks
+// does directly on a raw string, so callers that already hold a Document
+// don't need to go around it to fo.content.
+func (d *Document) PlatformBlocks() []*platformTarget {
+	return parsePlatformBlocks(d.String())
+}
+
+// BottleBlock returns d's `bottle do ... end` stanza, or nil if it has none.
+// It is the Document entry point for bottle.go's parseBottleBlock.
+func (d *Document) BottleBlock() *bottleBlock {
+	return parseBottleBlock(d.String())
+}
+
+// blockOpenReg matches a line that opens a nested do/end block, e.g.
+// `on_arm do` or `on_intel do` — any line whose last word is a bare `do`.
+var blockOpenReg = regexp.MustCompile(`(?m)^\s*\S.*\bdo\s*$`)
+
+// blockKeywordOpenReg matches a line that opens an `end`-terminated Ruby
+// block via a keyword rather than a trailing `do` — an `if`/`unless`/
+// `while`/`until`/`case`/`def`/`class`/`module`/`begin` nested inside an
+// on_macos/on_linux/bottle block (e.g. a `if build.head? ... end` guard).
+// Anchoring the keyword at the start of the line excludes the modifier form
+// (`return x if y`), which opens no block and has no matching `end`.
+var blockKeywordOpenReg = regexp.MustCompile(`(?m)^\s*(if|unless|while|until|case|def|class|module|begin)\b`)
+
+// blockEndReg matches a line that closes a do/end block on its own.
+var blockEndReg = regexp.MustCompile(`(?m)^\s*end\s*$`)
+
+// findDoEndBlock locates the first "... do ... end" block in content whose
+// opening line matches startReg, honoring nested `end`-terminated
+// constructs — on_arm/on_intel nested inside on_macos, but also a plain
+// `if`/`unless`/`while`/`until`/`case`/`def`/`class`/`module`/`begin` inside
+// the block — so an inner `end` isn't mistaken for the outer block's own.
+// This is what lets platform.go and bottle.go share one piece of
+// block-boundary logic instead of each reimplementing a (lazy,
+// nesting-unaware) regex of their own.
+//
+// It returns the byte offsets of the whole block (start/end, including the
+// opening and closing lines) and of its body (bodyStart/bodyEnd, the text
+// strictly between them), or ok=false if content has no such block.
+func findDoEndBlock(content string, startReg *regexp.Regexp) (start, bodyStart, bodyEnd, end int, ok bool) {
+	loc := startReg.FindStringIndex(content)
+	if loc == nil {
+		return 0, 0, 0, 0, false
+	}
+	start = loc[0]
+	bodyStart = loc[1]
+	if bodyStart < len(content) && content[bodyStart] == '\n' {
+		bodyStart++
+	}
+
+	depth := 1
+	pos := bodyStart
+	for pos <= len(content) {
+		nl := strings.IndexByte(content[pos:], '\n')
+		var line string
+		var lineLen int
+		if nl < 0 {
+			line, lineLen = content[pos:], len(content)-pos
+		} else {
+			line, lineLen = content[pos:pos+nl], nl+1
+		}
+
+		switch {
+		case blockEndReg.MatchString(line):
+			depth--
+			if depth == 0 {
+				bodyEnd = pos
+				end = pos + lineLen
+				if end > len(content) {
+					end = len(content)
+				}
+				return start, bodyStart, bodyEnd, end, true
+			}
+		case blockOpenReg.MatchString(line), blockKeywordOpenReg.MatchString(line):
+			depth++
+		}
+
+		if nl < 0 {
+			break
+		}
+		pos += lineLen
+	}
+
+	return 0, 0, 0, 0, false
+}
@@ -0,0 +1,181 @@
+package maltmill
+
+import (
+	"strings"
+	"testing"
+)
+
+const testFormula = `class Foo < Formula
+  # sha256 mentioned in a comment should never be picked up
+  desc "Example"
+  name = "foo"
+  version '1.0.0'
+  url "https://example.com/foo-1.0.0.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+
+  def caveats
+    <<~EOS
+      version '9.9.9'
+      sha256 'deadbeef'
+    EOS
+  end
+end
+`
+
+func TestParseDocumentSkipsCommentsAndHeredocs(t *testing.T) {
+	doc, err := parseDocument(testFormula)
+	if err != nil {
+		t.Fatalf("parseDocument() error = %v", err)
+	}
+
+	if got := doc.Name(); got != "foo" {
+		t.Errorf("Name() = %q, want foo", got)
+	}
+	if got := doc.Version(); got != "1.0.0" {
+		t.Errorf("Version() = %q, want 1.0.0", got)
+	}
+	if got := doc.URL(); got != "https://example.com/foo-1.0.0.tar.gz" {
+		t.Errorf("URL() = %q, want the top-level url", got)
+	}
+	if got := doc.SHA256(); got != "0000000000000000000000000000000000000000000000000000000000000000" {
+		t.Errorf("SHA256() = %q, want the top-level sha256, not the heredoc's", got)
+	}
+}
+
+func TestDocumentSetFieldsRoundTrip(t *testing.T) {
+	doc, err := parseDocument(testFormula)
+	if err != nil {
+		t.Fatalf("parseDocument() error = %v", err)
+	}
+
+	doc.SetVersion("2.0.0")
+	doc.SetURL("https://example.com/foo-2.0.0.tar.gz")
+	doc.SetSHA256("1111111111111111111111111111111111111111111111111111111111111111")
+
+	out := doc.String()
+	doc2, err := parseDocument(out)
+	if err != nil {
+		t.Fatalf("parseDocument(out) error = %v", err)
+	}
+	if got := doc2.Version(); got != "2.0.0" {
+		t.Errorf("Version() after round-trip = %q, want 2.0.0", got)
+	}
+	if got := doc2.URL(); got != "https://example.com/foo-2.0.0.tar.gz" {
+		t.Errorf("URL() after round-trip = %q, want the new url", got)
+	}
+	if got := doc2.SHA256(); got != "1111111111111111111111111111111111111111111111111111111111111111" {
+		t.Errorf("SHA256() after round-trip = %q, want the new sha256", got)
+	}
+	// A field that was not set must read back unchanged.
+	if got := doc2.Name(); got != "foo" {
+		t.Errorf("Name() after round-trip = %q, want foo (unchanged)", got)
+	}
+}
+
+const testFormulaTrackInHeredoc = `class Foo < Formula
+  name = "foo"
+  version '1.0.0'
+  url "https://example.com/foo-1.0.0.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+  # maltmill-track: ^1.2
+
+  def caveats
+    <<~EOS
+      This formula tracks releases using:
+        # maltmill-track: ^9.9
+        # maltmill-track-prereleases: true
+    EOS
+  end
+end
+`
+
+func TestDocumentTrackConstraintSkipsHeredocs(t *testing.T) {
+	doc, err := parseDocument(testFormulaTrackInHeredoc)
+	if err != nil {
+		t.Fatalf("parseDocument() error = %v", err)
+	}
+
+	if got := doc.TrackConstraint(); got != "^1.2" {
+		t.Errorf("TrackConstraint() = %q, want ^1.2 (the real top-level comment, not the heredoc's)", got)
+	}
+	if doc.TrackPrereleases() {
+		t.Error("TrackPrereleases() = true, want false (only mentioned inside the caveats heredoc)")
+	}
+}
+
+func TestFindDoEndBlockHandlesNesting(t *testing.T) {
+	content := `on_macos do
+  on_arm do
+    url "arm"
+  end
+  on_intel do
+    url "intel"
+  end
+end
+after
+`
+	start, bodyStart, bodyEnd, end, ok := findDoEndBlock(content, onMacosStartReg)
+	if !ok {
+		t.Fatal("findDoEndBlock() ok = false, want true")
+	}
+	if content[start:bodyStart] != "on_macos do\n" {
+		t.Errorf("opening line = %q, want %q", content[start:bodyStart], "on_macos do\n")
+	}
+	if content[end:] != "after\n" {
+		t.Errorf("text after block = %q, want %q", content[end:], "after\n")
+	}
+	body := content[bodyStart:bodyEnd]
+	if got, want := body, "  on_arm do\n    url \"arm\"\n  end\n  on_intel do\n    url \"intel\"\n  end\n"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestFindDoEndBlockHandlesNonDoNesting(t *testing.T) {
+	content := `on_macos do
+  on_arm do
+    url "arm"
+  end
+  on_intel do
+    url "intel"
+  end
+  if some_flag
+    puts "debug"
+  end
+end
+after
+`
+	start, _, bodyEnd, end, ok := findDoEndBlock(content, onMacosStartReg)
+	if !ok {
+		t.Fatal("findDoEndBlock() ok = false, want true")
+	}
+	// The block's own "end" is the last line before "after", not the "if"
+	// guard's "end" a few lines earlier.
+	if content[end:] != "after\n" {
+		t.Errorf("text after block = %q, want %q", content[end:], "after\n")
+	}
+	body := content[start:bodyEnd]
+	if !strings.Contains(body, `if some_flag`) || !strings.Contains(body, `puts "debug"`) {
+		t.Errorf("body = %q, want it to contain the if guard", body)
+	}
+}
+
+func TestDocumentPlatformBlocksAndBottleBlock(t *testing.T) {
+	doc, err := parseDocument(testFormulaWithBottle)
+	if err != nil {
+		t.Fatalf("parseDocument() error = %v", err)
+	}
+
+	bottle := doc.BottleBlock()
+	if bottle == nil {
+		t.Fatal("BottleBlock() = nil, want a bottle block")
+	}
+	if len(bottle.targets) != 2 {
+		t.Errorf("len(BottleBlock().targets) = %d, want 2", len(bottle.targets))
+	}
+
+	// testFormulaWithBottle has no on_macos/on_linux blocks, so the formula
+	// falls back to its single top-level url/sha256.
+	if got := doc.PlatformBlocks(); got != nil {
+		t.Errorf("PlatformBlocks() = %v, want nil", got)
+	}
+}
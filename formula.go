@@ -1,7 +1,6 @@
 package maltmill
 
 import (
-	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -9,10 +8,11 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/Masterminds/semver"
-	"github.com/google/go-github/github"
 	"github.com/pkg/errors"
 )
 
@@ -20,10 +20,31 @@ type formula struct {
 	fname string
 
 	content                    string
+	doc                        *Document
 	urlTmpl                    string
 	isURLTmpl                  bool
 	name, version, url, sha256 string
-	owner, repo                string
+	host, owner, repo          string
+
+	// platforms holds one entry per on_macos/on_linux/on_arm/on_intel
+	// url+sha256 pair found in content, or a single degenerate entry
+	// wrapping url/sha256 above when the formula has no such blocks.
+	platforms []*platformTarget
+	// matchers optionally overrides the asset-filename matcher used per
+	// platform, keyed "os" or "os_arch"; see matcherFor.
+	matchers map[string]*regexp.Regexp
+
+	// constraint, parsed from a "# maltmill-track: ..." comment (or set via
+	// setTrackConstraint), pins updates to a semver range instead of always
+	// jumping to the latest release. trackPrereleases additionally allows
+	// prerelease tags to satisfy it.
+	constraint       *semver.Constraints
+	trackPrereleases bool
+
+	// bottle is the formula's `bottle do ... end` block, or nil if it has
+	// none. mode controls how update treats it; see bottleMode.
+	bottle *bottleBlock
+	mode   bottleMode
 }
 
 var (
@@ -32,7 +53,7 @@ var (
 	urlReg  = regexp.MustCompile(`(?m)(^\s+url\s*['"])(.*)(["'])`)
 	shaReg  = regexp.MustCompile(`(?m)(\s+sha256\s*['"])(.*)(["'])`)
 
-	parseURLReg = regexp.MustCompile(`^https://[^/]*github.com/([^/]+)/([^/]+)`)
+	parseURLReg = regexp.MustCompile(`^https://([^/]+)/([^/]+)/([^/]+)`)
 )
 
 func newFormula(f string) (*formula, error) {
@@ -43,31 +64,33 @@ func newFormula(f string) (*formula, error) {
 	fo := &formula{fname: f}
 	fo.content = string(b)
 
-	if m := nameReg.FindStringSubmatch(fo.content); len(m) > 1 {
-		fo.name = m[1]
+	doc, err := parseDocument(fo.content)
+	if err != nil {
+		return nil, err
 	}
-	m := verReg.FindStringSubmatch(fo.content)
-	if len(m) < 4 {
+	fo.doc = doc
+
+	fo.name = doc.Name()
+
+	fo.version = doc.Version()
+	if fo.version == "" {
 		return nil, errors.New("no version detected")
 	}
-	fo.version = m[2]
 
-	m = shaReg.FindStringSubmatch(fo.content)
-	if len(m) < 4 {
+	fo.sha256 = doc.SHA256()
+	if fo.sha256 == "" {
 		return nil, errors.New("no sha256 detected")
 	}
-	fo.sha256 = m[2]
 
 	info := map[string]string{
 		"name":    fo.name,
 		"version": fo.version,
 	}
 
-	m = urlReg.FindStringSubmatch(fo.content)
-	if len(m) < 4 {
+	fo.urlTmpl = doc.URL()
+	if fo.urlTmpl == "" {
 		return nil, errors.New("no url detected")
 	}
-	fo.urlTmpl = m[2]
 	fo.isURLTmpl = strings.Contains(fo.urlTmpl, "#{version}")
 
 	if fo.isURLTmpl {
@@ -79,12 +102,41 @@ func newFormula(f string) (*formula, error) {
 		fo.url = fo.urlTmpl
 	}
 
-	m = parseURLReg.FindStringSubmatch(fo.url)
-	if len(m) < 3 {
+	m := parseURLReg.FindStringSubmatch(fo.url)
+	if len(m) < 4 {
 		return nil, errors.Errorf("invalid url format: %s", fo.urlTmpl)
 	}
-	fo.owner = m[1]
-	fo.repo = m[2]
+	fo.host = m[1]
+	fo.owner = m[2]
+	fo.repo = strings.TrimSuffix(m[3], ".git")
+
+	fo.constraint, err = parseTrackConstraint(doc)
+	if err != nil {
+		return nil, err
+	}
+	fo.trackPrereleases = doc.TrackPrereleases()
+
+	fo.bottle = doc.BottleBlock()
+
+	fo.platforms = doc.PlatformBlocks()
+	if len(fo.platforms) == 0 {
+		// No on_macos/on_linux blocks: wrap the single top-level url/sha256,
+		// keeping the historical darwin/amd64 asset match as the default.
+		fo.platforms = []*platformTarget{{
+			os: "darwin", arch: "amd64",
+			url: fo.url, sha256: fo.sha256,
+			blockStart: -1, blockEnd: -1,
+		}}
+	} else if doc.URLIsTopLevel(fo.platforms) {
+		// A formula that both builds from a top-level url/sha256 and ships
+		// on_macos/on_linux bottles has two things update would need to keep
+		// in sync, and only the blocks are tracked as platformTargets: update
+		// would bump version while leaving this pair pointing at the old
+		// release, silently breaking `brew install --build-from-source`.
+		// Reject it rather than guess which release asset the legacy
+		// top-level url/sha256 should be refreshed from.
+		return nil, errors.New("formula has both a top-level url/sha256 and on_macos/on_linux blocks: unsupported, use one or the other")
+	}
 
 	return fo, nil
 }
@@ -100,19 +152,31 @@ func expandStr(str string, m map[string]string) (string, error) {
 	return str, nil
 }
 
-func (fo *formula) update(ghcli *github.Client) (updated bool, err error) {
+// update fetches the latest release for fo's host and, if it is newer than
+// fo's current version, rewrites fo's content in place. tokens holds
+// per-host auth tokens keyed by hostname (e.g. "gitlab.example.com"),
+// looked up by fo.host.
+func (fo *formula) update(tokens map[string]string) (updated bool, err error) {
+	return fo.updateWithProvider(newReleaseProvider(fo.host, tokens[fo.host]))
+}
+
+// updateWithProvider is update's actual implementation, taking the
+// releaseProvider as a parameter instead of constructing one from fo.host,
+// so a test can drive the real fetch/resolve/rewrite pipeline — the
+// parallel per-platform asset fetch and bottle refresh below included —
+// against a stub or an httptest server instead of a live host.
+func (fo *formula) updateWithProvider(provider releaseProvider) (updated bool, err error) {
 	origVer, err := semver.NewVersion(fo.version)
 	if err != nil {
 		return false, errors.Wrap(err, "invalid original version")
 	}
 
-	rele, resp, err := ghcli.Repositories.GetLatestRelease(context.Background(), fo.owner, fo.repo)
+	rele, err := fo.latestMatchingRelease(provider)
 	if err != nil {
 		return false, errors.Wrapf(err, "update formula failed: %s", fo.fname)
 	}
-	resp.Body.Close()
 
-	newVer, err := semver.NewVersion(rele.GetTagName())
+	newVer, err := semver.NewVersion(rele.tagName)
 	if err != nil {
 		return false, errors.Wrapf(err, "invalid original version. formula: %s", fo.fname)
 	}
@@ -120,54 +184,100 @@ func (fo *formula) update(ghcli *github.Client) (updated bool, err error) {
 		return false, nil
 	}
 
-	newVerStr := fmt.Sprintf("%d.%d.%d", newVer.Major(), newVer.Minor(), newVer.Patch())
-	var newURL string
-	if fo.isURLTmpl {
-		newURL, err = expandStr(fo.urlTmpl, map[string]string{
-			"name":    fo.name,
-			"version": newVerStr,
-		})
+	// newVer.String() keeps any prerelease/build-metadata suffix (e.g.
+	// "2.0.0-rc1"), which matters when maltmill-track-prereleases accepted a
+	// prerelease tag: dropping the suffix would make the formula
+	// indistinguishable from a final release.
+	newVerStr := newVer.String()
+
+	newURLs := make([]string, len(fo.platforms))
+	for i, t := range fo.platforms {
+		newURLs[i], err = fo.resolveAssetURL(t, rele, newVerStr)
 		if err != nil {
 			return false, errors.Wrapf(err, "faild to upload formula: %s", fo.fname)
 		}
-	} else {
-		newURL, err = func() (string, error) {
-			ext := path.Ext(fo.url)
-			for _, asset := range rele.Assets {
-				u := asset.GetBrowserDownloadURL()
-				fname := path.Base(u)
-				// edit distance is better?
-				if strings.Contains(fname, "amd64") &&
-					strings.Contains(fname, "darwin") &&
-					strings.HasSuffix(fname, ext) {
-					return u, nil
-				}
-			}
-			return "", errors.New("no assets found from latest release")
-		}()
-		if err != nil {
-			return false, err
-		}
 	}
 
-	newSHA256, err := getSHA256FromURL(newURL)
-	if err != nil {
-		return false, errors.Wrapf(err, "faild to upload formula: %s", fo.fname)
+	newSHA256s := make([]string, len(fo.platforms))
+	fetchErrs := make([]error, len(fo.platforms))
+	var wg sync.WaitGroup
+	for i, u := range newURLs {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			newSHA256s[i], fetchErrs[i] = getSHA256FromURL(u)
+		}(i, u)
+	}
+	wg.Wait()
+	for _, fetchErr := range fetchErrs {
+		if fetchErr != nil {
+			return false, errors.Wrapf(fetchErr, "faild to upload formula: %s", fo.fname)
+		}
 	}
+
 	fo.version = newVerStr
-	fo.url = newURL
-	fo.sha256 = newSHA256
+	for i, t := range fo.platforms {
+		t.url = newURLs[i]
+		t.sha256 = newSHA256s[i]
+	}
+	if len(fo.platforms) == 1 && fo.platforms[0].blockStart < 0 {
+		fo.url = fo.platforms[0].url
+		fo.sha256 = fo.platforms[0].sha256
+	}
 	fo.updateContent()
 
 	return true, nil
 }
 
-// update version and sha256
+// resolveAssetURL finds the release asset for a single platform target. The
+// legacy single-URL formula (fo.isURLTmpl with no platform blocks) expands
+// the URL template directly instead of scanning release assets.
+func (fo *formula) resolveAssetURL(t *platformTarget, rele *release, newVerStr string) (string, error) {
+	if fo.isURLTmpl && t.blockStart < 0 {
+		return expandStr(fo.urlTmpl, map[string]string{
+			"name":    fo.name,
+			"version": newVerStr,
+		})
+	}
+
+	u, err := pickAsset(rele.assets, fo.matcherFor(t.os, t.arch), path.Ext(t.url))
+	if err != nil {
+		return "", errors.Wrapf(err, "%s/%s", t.os, t.arch)
+	}
+	return u, nil
+}
+
+// updateContent rewrites fo.content with the new version, either the new
+// url/sha256 (single-URL formulae) or each platform block's new url/sha256
+// (multi-platform formulae), and fo.bottle per fo.mode. The version line is
+// rewritten last and re-located fresh through a new Document, since the
+// rewrites above can shift byte offsets elsewhere in the file.
 func (fo *formula) updateContent() {
-	fo.content = replaceOne(verReg, fo.content, fmt.Sprintf(`${1}%s${3}`, fo.version))
-	fo.content = replaceOne(shaReg, fo.content, fmt.Sprintf(`${1}%s${3}`, fo.sha256))
-	if !fo.isURLTmpl {
-		fo.content = replaceOne(urlReg, fo.content, fmt.Sprintf(`${1}%s${3}`, fo.url))
+	if len(fo.platforms) == 1 && fo.platforms[0].blockStart < 0 {
+		fo.doc.SetSHA256(fo.sha256)
+		if !fo.isURLTmpl {
+			fo.doc.SetURL(fo.url)
+		}
+		fo.content = fo.doc.String()
+	} else {
+		// Rewrite each on_macos/on_linux/on_arm/on_intel block independently,
+		// from the end of content backwards so earlier blocks' byte offsets
+		// stay valid as later blocks are replaced.
+		targets := append([]*platformTarget(nil), fo.platforms...)
+		sort.Slice(targets, func(i, j int) bool { return targets[i].blockStart > targets[j].blockStart })
+		for _, t := range targets {
+			block := fo.content[t.blockStart:t.blockEnd]
+			block = replaceOne(urlReg, block, fmt.Sprintf(`${1}%s${3}`, t.url))
+			block = replaceOne(shaReg, block, fmt.Sprintf(`${1}%s${3}`, t.sha256))
+			fo.content = fo.content[:t.blockStart] + block + fo.content[t.blockEnd:]
+		}
+	}
+
+	fo.rewriteBottle()
+
+	if doc, err := parseDocument(fo.content); err == nil {
+		doc.SetVersion(fo.version)
+		fo.content = doc.String()
 	}
 }
 
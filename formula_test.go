@@ -0,0 +1,260 @@
+package maltmill
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newAssetServer starts an httptest.Server that serves a distinct fixed
+// body per request path, so a test can assert the sha256 formula.update
+// computes for an asset against one it computes the same way here.
+func newAssetServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "content of %s", r.URL.Path)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func sha256Hex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+func TestNewFormulaRejectsTopLevelURLMixedWithPlatformBlocks(t *testing.T) {
+	content := `class Foo < Formula
+  version '1.0.0'
+  url "https://example.com/owner/repo/foo-1.0.0.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+
+  on_macos do
+    url "https://example.com/owner/repo/foo-1.0.0-darwin-amd64.tar.gz"
+    sha256 "1111111111111111111111111111111111111111111111111111111111111111"
+  end
+end
+`
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := newFormula(path); err == nil {
+		t.Fatal("newFormula() error = nil, want an error for a formula mixing a top-level url/sha256 with on_macos/on_linux blocks")
+	}
+}
+
+func TestNewFormulaRejectsPlatformBlocksMixedWithTopLevelURLBeforeIt(t *testing.T) {
+	// Same mixed shape as above, but with the on_macos block declared before
+	// the legacy top-level url/sha256 pair in the file.
+	content := `class Foo < Formula
+  version '1.0.0'
+
+  on_macos do
+    url "https://example.com/owner/repo/foo-1.0.0-darwin-amd64.tar.gz"
+    sha256 "1111111111111111111111111111111111111111111111111111111111111111"
+  end
+
+  url "https://example.com/owner/repo/foo-1.0.0.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+end
+`
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := newFormula(path); err == nil {
+		t.Fatal("newFormula() error = nil, want an error regardless of whether the block or the top-level pair comes first")
+	}
+}
+
+// TestFormulaUpdateSingleURLTemplate exercises update's single-URL path end
+// to end: expand the #{version} template against the stubbed latest
+// release, fetch the asset from a real server, and rewrite version/sha256
+// in place.
+func TestFormulaUpdateSingleURLTemplate(t *testing.T) {
+	ts := newAssetServer(t)
+
+	// newFormula's parseURLReg requires an "https://" url, which the local
+	// httptest server can't offer; give it a placeholder https url to parse
+	// successfully, then point fo.urlTmpl at the real server afterwards, the
+	// same way tests stub the releaseProvider instead of hitting a live host.
+	content := `class Foo < Formula
+  version '1.0.0'
+  url "https://example.com/owner/repo/foo-#{version}.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+end
+`
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	fo, err := newFormula(path)
+	if err != nil {
+		t.Fatalf("newFormula() error = %v", err)
+	}
+	fo.urlTmpl = ts.URL + "/owner/repo/foo-#{version}.tar.gz"
+
+	provider := &stubProvider{releases: tagReleases("2.0.0")}
+	updated, err := fo.updateWithProvider(provider)
+	if err != nil {
+		t.Fatalf("updateWithProvider() error = %v", err)
+	}
+	if !updated {
+		t.Fatal("updateWithProvider() updated = false, want true")
+	}
+
+	wantSHA := sha256Hex("content of /owner/repo/foo-2.0.0.tar.gz")
+
+	doc, err := parseDocument(fo.content)
+	if err != nil {
+		t.Fatalf("parseDocument(fo.content) error = %v", err)
+	}
+	if got := doc.Version(); got != "2.0.0" {
+		t.Errorf("Version() = %q, want 2.0.0", got)
+	}
+	// The url line is a #{version} template, so it's left untouched on
+	// disk - only the version it expands against, and the sha256 fetched
+	// through that expansion, change.
+	if got := doc.URL(); got != "https://example.com/owner/repo/foo-#{version}.tar.gz" {
+		t.Errorf("URL() = %q, want the template left unchanged", got)
+	}
+	if got := doc.SHA256(); got != wantSHA {
+		t.Errorf("SHA256() = %q, want %q", got, wantSHA)
+	}
+}
+
+// TestFormulaUpdateMultiPlatform exercises update's on_macos/on_arm/
+// on_intel path end to end: pick a matching asset per platform, fetch both
+// in parallel, and rewrite each block's url/sha256 independently.
+func TestFormulaUpdateMultiPlatform(t *testing.T) {
+	ts := newAssetServer(t)
+
+	content := `class Foo < Formula
+  version '1.0.0'
+
+  on_macos do
+    on_arm do
+      url "https://example.com/owner/repo/foo-1.0.0-darwin-arm64.tar.gz"
+      sha256 "1111111111111111111111111111111111111111111111111111111111111111"
+    end
+    on_intel do
+      url "https://example.com/owner/repo/foo-1.0.0-darwin-amd64.tar.gz"
+      sha256 "2222222222222222222222222222222222222222222222222222222222222222"
+    end
+  end
+end
+`
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	fo, err := newFormula(path)
+	if err != nil {
+		t.Fatalf("newFormula() error = %v", err)
+	}
+
+	provider := &stubProvider{releases: tagReleases("2.0.0")}
+	provider.releases[0].assets = []releaseAsset{
+		{name: "foo-darwin-arm64.tar.gz", browserDownloadURL: ts.URL + "/foo-darwin-arm64.tar.gz"},
+		{name: "foo-darwin-amd64.tar.gz", browserDownloadURL: ts.URL + "/foo-darwin-amd64.tar.gz"},
+	}
+
+	updated, err := fo.updateWithProvider(provider)
+	if err != nil {
+		t.Fatalf("updateWithProvider() error = %v", err)
+	}
+	if !updated {
+		t.Fatal("updateWithProvider() updated = false, want true")
+	}
+
+	doc, err := parseDocument(fo.content)
+	if err != nil {
+		t.Fatalf("parseDocument(fo.content) error = %v", err)
+	}
+	if got := doc.Version(); got != "2.0.0" {
+		t.Errorf("Version() = %q, want 2.0.0", got)
+	}
+
+	targets := doc.PlatformBlocks()
+	if len(targets) != 2 {
+		t.Fatalf("PlatformBlocks() = %d targets, want 2", len(targets))
+	}
+	for _, target := range targets {
+		wantURL := ts.URL + "/foo-darwin-" + target.arch + ".tar.gz"
+		wantSHA := sha256Hex("content of /foo-darwin-" + target.arch + ".tar.gz")
+		if target.url != wantURL {
+			t.Errorf("%s url = %q, want %q", target.arch, target.url, wantURL)
+		}
+		if target.sha256 != wantSHA {
+			t.Errorf("%s sha256 = %q, want %q", target.arch, target.sha256, wantSHA)
+		}
+	}
+}
+
+// TestFormulaUpdateBottleRefresh exercises the bottleRefresh path end to
+// end: a single on_macos block (no arm/intel split, matching any arch per
+// platformSHA256) feeds its freshly fetched hash into the bottle block's
+// matching target.
+func TestFormulaUpdateBottleRefresh(t *testing.T) {
+	ts := newAssetServer(t)
+
+	content := `class Foo < Formula
+  version '1.0.0'
+
+  on_macos do
+    url "https://example.com/owner/repo/foo-1.0.0-darwin.tar.gz"
+    sha256 "1111111111111111111111111111111111111111111111111111111111111111"
+  end
+
+  bottle do
+    root_url "https://example.com/bottles"
+    sha256 cellar: :any, arm64_sonoma: "3333333333333333333333333333333333333333333333333333333333333333"
+  end
+end
+`
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	fo, err := newFormula(path)
+	if err != nil {
+		t.Fatalf("newFormula() error = %v", err)
+	}
+	if err := fo.setBottleMode("refresh"); err != nil {
+		t.Fatalf("setBottleMode() error = %v", err)
+	}
+
+	provider := &stubProvider{releases: tagReleases("2.0.0")}
+	provider.releases[0].assets = []releaseAsset{
+		{name: "foo-darwin.tar.gz", browserDownloadURL: ts.URL + "/foo-darwin.tar.gz"},
+	}
+
+	updated, err := fo.updateWithProvider(provider)
+	if err != nil {
+		t.Fatalf("updateWithProvider() error = %v", err)
+	}
+	if !updated {
+		t.Fatal("updateWithProvider() updated = false, want true")
+	}
+
+	wantSHA := sha256Hex("content of /foo-darwin.tar.gz")
+	bottle := parseBottleBlock(fo.content)
+	if bottle == nil {
+		t.Fatal("parseBottleBlock(fo.content) = nil, want the bottle block preserved")
+	}
+	if len(bottle.targets) != 1 || bottle.targets[0].sha256 != wantSHA {
+		t.Errorf("bottle targets = %+v, want arm64_sonoma refreshed to %q", bottle.targets, wantSHA)
+	}
+	if bottle.rootURL != "https://example.com/bottles" {
+		t.Errorf("rootURL = %q, want it preserved verbatim", bottle.rootURL)
+	}
+}
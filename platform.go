@@ -0,0 +1,148 @@
+package maltmill
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// platformTarget is one url/sha256 pair for a specific (os, arch)
+// combination, corresponding to a `url`/`sha256` pair nested inside an
+// `on_macos`/`on_linux`/`on_arm`/`on_intel` block. A formula with no such
+// blocks gets a single platformTarget with blockStart/blockEnd set to -1,
+// wrapping the top-level url/sha256 parsed by newFormula — the single-URL
+// case is a degenerate path through the same update/rewrite code.
+type platformTarget struct {
+	os, arch    string
+	url, sha256 string
+
+	// blockStart/blockEnd are byte offsets of this target's block body
+	// within formula.content, used to rewrite each block independently.
+	// -1 means there is no block: the top-level url/sha256 lines are
+	// rewritten through formula.doc instead.
+	blockStart, blockEnd int
+}
+
+var (
+	onMacosStartReg = regexp.MustCompile(`(?m)^\s*on_macos\s+do\s*$`)
+	onLinuxStartReg = regexp.MustCompile(`(?m)^\s*on_linux\s+do\s*$`)
+	onArmStartReg   = regexp.MustCompile(`(?m)^\s*on_arm\s+do\s*$`)
+	onIntelStartReg = regexp.MustCompile(`(?m)^\s*on_intel\s+do\s*$`)
+)
+
+// defaultMatchers gives a fallback asset-filename matcher per "os_arch" key,
+// used by matcherFor when no override is configured.
+var defaultMatchers = map[string]*regexp.Regexp{
+	"darwin_arm64": regexp.MustCompile(`(?i)darwin.*arm64`),
+	"darwin_amd64": regexp.MustCompile(`(?i)darwin.*amd64`),
+	"linux_arm64":  regexp.MustCompile(`(?i)linux.*arm64`),
+	"linux_amd64":  regexp.MustCompile(`(?i)linux.*amd64`),
+}
+
+// parsePlatformBlocks scans content for on_macos/on_linux blocks and, within
+// each, the nested on_arm/on_intel blocks, returning one platformTarget
+// per leaf url/sha256 pair it finds. It returns nil if content has none,
+// meaning the formula uses the single top-level url/sha256 instead.
+//
+// Block boundaries are found via findDoEndBlock, which counts nested
+// do/end pairs instead of matching up to the first "end" line: on_arm and
+// on_intel both nest inside on_macos, so a lazy "on_macos do ... end" regex
+// would stop at on_arm's closing end and mis-parse (or silently drop)
+// on_intel entirely.
+func parsePlatformBlocks(content string) []*platformTarget {
+	var targets []*platformTarget
+	if _, bodyStart, bodyEnd, _, ok := findDoEndBlock(content, onMacosStartReg); ok {
+		targets = append(targets, parseNestedArch(content, bodyStart, bodyEnd, "darwin")...)
+	}
+	if _, bodyStart, bodyEnd, _, ok := findDoEndBlock(content, onLinuxStartReg); ok {
+		targets = append(targets, parseNestedArch(content, bodyStart, bodyEnd, "linux")...)
+	}
+	return targets
+}
+
+// parseNestedArch looks for on_arm/on_intel blocks within content[start:end]
+// (the body of an on_macos/on_linux block) and returns one target per match.
+// If neither is present, content[start:end] itself is the leaf block.
+func parseNestedArch(content string, start, end int, os string) []*platformTarget {
+	body := content[start:end]
+	var targets []*platformTarget
+	if _, bodyStart, bodyEnd, _, ok := findDoEndBlock(body, onArmStartReg); ok {
+		targets = append(targets, leafTarget(content, start+bodyStart, start+bodyEnd, os, "arm64"))
+	}
+	if _, bodyStart, bodyEnd, _, ok := findDoEndBlock(body, onIntelStartReg); ok {
+		targets = append(targets, leafTarget(content, start+bodyStart, start+bodyEnd, os, "amd64"))
+	}
+	if len(targets) == 0 {
+		targets = append(targets, leafTarget(content, start, end, os, ""))
+	}
+	return targets
+}
+
+func leafTarget(content string, start, end int, os, arch string) *platformTarget {
+	body := content[start:end]
+	t := &platformTarget{os: os, arch: arch, blockStart: start, blockEnd: end}
+	if m := urlReg.FindStringSubmatch(body); len(m) > 2 {
+		t.url = m[2]
+	}
+	if m := shaReg.FindStringSubmatch(body); len(m) > 2 {
+		t.sha256 = m[2]
+	}
+	return t
+}
+
+// setMatcher overrides the asset-filename matcher fo uses for a platform
+// (keyed "os" or "os_arch", e.g. "darwin_arm64") with a custom regex, e.g.
+// `darwin.*arm64\.tar\.gz`, instead of the built-in guess in
+// defaultMatchers. This is the configurable per-platform matcher that
+// matcherFor consults first.
+func (fo *formula) setMatcher(key, pattern string) error {
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid matcher for %s", key)
+	}
+	if fo.matchers == nil {
+		fo.matchers = map[string]*regexp.Regexp{}
+	}
+	fo.matchers[key] = reg
+	return nil
+}
+
+// matcherFor returns the asset-filename matcher for a platform, preferring
+// an override from fo.matchers (keyed "os" or "os_arch") and falling back
+// to defaultMatchers, or a generic os/arch substring match if neither is
+// configured. This is how callers plug in a custom regex per platform (e.g.
+// `darwin.*arm64\.tar\.gz`) instead of the built-in guesses. Overrides are
+// always compiled as Go regular expressions; glob patterns are not
+// recognized.
+func (fo *formula) matcherFor(os, arch string) *regexp.Regexp {
+	key := os
+	if arch != "" {
+		key = os + "_" + arch
+	}
+	if reg, ok := fo.matchers[key]; ok {
+		return reg
+	}
+	if reg, ok := defaultMatchers[key]; ok {
+		return reg
+	}
+	pattern := regexp.QuoteMeta(os)
+	if arch != "" {
+		pattern += `.*` + regexp.QuoteMeta(arch)
+	}
+	return regexp.MustCompile(`(?i)` + pattern)
+}
+
+// pickAsset returns the download URL of the first asset whose filename
+// matches matcher and, when ext is non-empty, also has that extension.
+func pickAsset(assets []releaseAsset, matcher *regexp.Regexp, ext string) (string, error) {
+	for _, asset := range assets {
+		u := asset.browserDownloadURL
+		fname := path.Base(u)
+		if matcher.MatchString(fname) && (ext == "" || strings.HasSuffix(fname, ext)) {
+			return u, nil
+		}
+	}
+	return "", errors.New("no assets found from latest release")
+}
@@ -0,0 +1,68 @@
+package maltmill
+
+import "testing"
+
+func TestParsePlatformBlocksNestedArmIntel(t *testing.T) {
+	content := `class Foo < Formula
+  version '1.0.0'
+
+  on_macos do
+    on_arm do
+      url "https://example.com/foo-1.0.0-darwin-arm64.tar.gz"
+      sha256 "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    end
+    on_intel do
+      url "https://example.com/foo-1.0.0-darwin-amd64.tar.gz"
+      sha256 "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+    end
+  end
+end
+`
+	targets := parsePlatformBlocks(content)
+	if len(targets) != 2 {
+		t.Fatalf("len(targets) = %d, want 2", len(targets))
+	}
+
+	want := map[string]struct{ url, sha256 string }{
+		"arm64": {"https://example.com/foo-1.0.0-darwin-arm64.tar.gz", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"amd64": {"https://example.com/foo-1.0.0-darwin-amd64.tar.gz", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	}
+	for _, target := range targets {
+		if target.os != "darwin" {
+			t.Errorf("target.os = %q, want darwin", target.os)
+		}
+		w, ok := want[target.arch]
+		if !ok {
+			t.Fatalf("unexpected target.arch = %q", target.arch)
+		}
+		if target.url != w.url || target.sha256 != w.sha256 {
+			t.Errorf("target[%s] = (%q, %q), want (%q, %q)", target.arch, target.url, target.sha256, w.url, w.sha256)
+		}
+		delete(want, target.arch)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing targets: %v", want)
+	}
+}
+
+func TestSetMatcherOverridesDefault(t *testing.T) {
+	fo := &formula{}
+	if err := fo.setMatcher("darwin_arm64", `darwin.*arm64\.tar\.gz`); err != nil {
+		t.Fatalf("setMatcher() error = %v", err)
+	}
+
+	reg := fo.matcherFor("darwin", "arm64")
+	if !reg.MatchString("foo-darwin-arm64.tar.gz") {
+		t.Errorf("matcherFor(darwin, arm64) = %q, want it to match foo-darwin-arm64.tar.gz", reg.String())
+	}
+	if reg.MatchString("foo-darwin-arm64.zip") {
+		t.Errorf("matcherFor(darwin, arm64) = %q, want it not to match foo-darwin-arm64.zip", reg.String())
+	}
+}
+
+func TestSetMatcherInvalidPattern(t *testing.T) {
+	fo := &formula{}
+	if err := fo.setMatcher("darwin_arm64", `(`); err == nil {
+		t.Fatal("setMatcher() error = nil, want error for invalid regex")
+	}
+}
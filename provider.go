@@ -0,0 +1,452 @@
+package maltmill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// release is a provider-agnostic view of a single release, used so that
+// formula and creator do not need to know which hosting service a repo
+// lives on.
+type release struct {
+	tagName string
+	assets  []releaseAsset
+}
+
+// releaseAsset is a single downloadable artifact attached to a release.
+type releaseAsset struct {
+	name               string
+	browserDownloadURL string
+}
+
+// releasesPerPage is the page size ListReleases requests from every
+// provider, chosen to be each API's own maximum so pagination needs the
+// fewest round trips.
+const releasesPerPage = 100
+
+// releaseProvider fetches releases from a repository hosting service.
+type releaseProvider interface {
+	GetLatestRelease(owner, repo string) (*release, error)
+	GetReleaseByTag(owner, repo, tag string) (*release, error)
+	ListReleases(owner, repo string) ([]*release, error)
+}
+
+// newReleaseProvider returns the releaseProvider responsible for host,
+// authenticating with token when the provider supports it. Hosts that
+// don't match a known public service are treated as self-hosted Gitea
+// instances, since that's the common case for a private source domain.
+func newReleaseProvider(host, token string) releaseProvider {
+	switch {
+	case host == "" || strings.HasSuffix(host, "github.com"):
+		return newGitHubProvider(host, token)
+	case strings.HasSuffix(host, "gitlab.com"):
+		return newGitLabProvider(host, token)
+	case strings.HasSuffix(host, "bitbucket.org"):
+		return newBitbucketProvider(host, token)
+	default:
+		return newGiteaProvider(host, token)
+	}
+}
+
+// githubProvider is a releaseProvider backed by the GitHub API.
+type githubProvider struct {
+	cli *github.Client
+}
+
+func newGitHubProvider(host, token string) *githubProvider {
+	return &githubProvider{cli: newGitHubClient(token)}
+}
+
+// newGitHubClient returns a github.Client that authenticates with token
+// when one is given, and an unauthenticated client otherwise.
+func newGitHubClient(token string) *github.Client {
+	if token == "" {
+		return github.NewClient(nil)
+	}
+	return github.NewClient(&http.Client{Transport: &tokenTransport{token: token}})
+}
+
+// tokenTransport adds a bearer token to every outgoing request.
+type tokenTransport struct {
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", t.token))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	return r
+}
+
+func (p *githubProvider) GetLatestRelease(owner, repo string) (*release, error) {
+	rele, resp, err := p.cli.Repositories.GetLatestRelease(context.Background(), owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return githubReleaseToRelease(rele), nil
+}
+
+func (p *githubProvider) GetReleaseByTag(owner, repo, tag string) (*release, error) {
+	rele, resp, err := p.cli.Repositories.GetReleaseByTag(context.Background(), owner, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return githubReleaseToRelease(rele), nil
+}
+
+// ListReleases pages through every release GitHub has for owner/repo, not
+// just the first page (30 releases by default) ListReleases(ctx, owner,
+// repo, nil) would return. latestMatchingRelease is the caller that
+// actually needs this: it looks for a release matching an older
+// maltmill-track constraint (e.g. "foo@1" on a repo long since at v3),
+// which on an active repo can sit well past page one.
+func (p *githubProvider) ListReleases(owner, repo string) ([]*release, error) {
+	var rs []*release
+	opt := &github.ListOptions{PerPage: releasesPerPage}
+	for {
+		releases, resp, err := p.cli.Repositories.ListReleases(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		for _, rele := range releases {
+			rs = append(rs, githubReleaseToRelease(rele))
+		}
+		if resp.NextPage == 0 {
+			return rs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func githubReleaseToRelease(rele *github.RepositoryRelease) *release {
+	assets := make([]releaseAsset, 0, len(rele.Assets))
+	for _, a := range rele.Assets {
+		assets = append(assets, releaseAsset{name: a.GetName(), browserDownloadURL: a.GetBrowserDownloadURL()})
+	}
+	return &release{tagName: rele.GetTagName(), assets: assets}
+}
+
+// gitlabProvider is a releaseProvider backed by the GitLab API.
+type gitlabProvider struct {
+	baseURL string
+	token   string
+}
+
+func newGitLabProvider(host, token string) *gitlabProvider {
+	if host == "" {
+		host = "gitlab.com"
+	}
+	return &gitlabProvider{baseURL: fmt.Sprintf("https://%s/api/v4", host), token: token}
+}
+
+type gitlabRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  struct {
+		Links []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+func (p *gitlabProvider) GetLatestRelease(owner, repo string) (*release, error) {
+	releases, err := p.ListReleases(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, errors.New("no releases found")
+	}
+	return releases[0], nil
+}
+
+func (p *gitlabProvider) GetReleaseByTag(owner, repo, tag string) (*release, error) {
+	var gr gitlabRelease
+	path := fmt.Sprintf("%s/projects/%s/releases/%s", p.baseURL, gitlabProjectPath(owner, repo), tag)
+	if err := p.get(path, &gr); err != nil {
+		return nil, err
+	}
+	return gitlabReleaseToRelease(&gr), nil
+}
+
+// ListReleases pages through every release GitLab has for owner/repo via
+// its page/per_page query params, the same reason githubProvider.ListReleases
+// does: latestMatchingRelease needs the full history, not just page one.
+func (p *gitlabProvider) ListReleases(owner, repo string) ([]*release, error) {
+	path := fmt.Sprintf("%s/projects/%s/releases", p.baseURL, gitlabProjectPath(owner, repo))
+	grs, err := paginatePages[gitlabRelease](p.get, func(page int) string {
+		return fmt.Sprintf("%s?page=%d&per_page=%d", path, page, releasesPerPage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]*release, len(grs))
+	for i := range grs {
+		rs[i] = gitlabReleaseToRelease(&grs[i])
+	}
+	return rs, nil
+}
+
+func gitlabProjectPath(owner, repo string) string {
+	return strings.Replace(owner+"/"+repo, "/", "%2F", -1)
+}
+
+func gitlabReleaseToRelease(gr *gitlabRelease) *release {
+	assets := make([]releaseAsset, 0, len(gr.Assets.Links))
+	for _, l := range gr.Assets.Links {
+		assets = append(assets, releaseAsset{name: l.Name, browserDownloadURL: l.URL})
+	}
+	return &release{tagName: gr.TagName, assets: assets}
+}
+
+func (p *gitlabProvider) get(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if p.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", p.token)
+	}
+	return doJSONRequest(req, v)
+}
+
+// giteaProvider is a releaseProvider backed by the Gitea API, also used for
+// self-hosted Gitea instances reached by their bare domain.
+type giteaProvider struct {
+	baseURL string
+	token   string
+}
+
+func newGiteaProvider(host, token string) *giteaProvider {
+	if host == "" {
+		host = "gitea.com"
+	}
+	return &giteaProvider{baseURL: fmt.Sprintf("https://%s/api/v1", host), token: token}
+}
+
+type giteaRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (p *giteaProvider) GetLatestRelease(owner, repo string) (*release, error) {
+	var gr giteaRelease
+	path := fmt.Sprintf("%s/repos/%s/%s/releases/latest", p.baseURL, owner, repo)
+	if err := p.get(path, &gr); err != nil {
+		return nil, err
+	}
+	return giteaReleaseToRelease(&gr), nil
+}
+
+func (p *giteaProvider) GetReleaseByTag(owner, repo, tag string) (*release, error) {
+	var gr giteaRelease
+	path := fmt.Sprintf("%s/repos/%s/%s/releases/tags/%s", p.baseURL, owner, repo, tag)
+	if err := p.get(path, &gr); err != nil {
+		return nil, err
+	}
+	return giteaReleaseToRelease(&gr), nil
+}
+
+// ListReleases pages through every release Gitea has for owner/repo via its
+// page/limit query params, for the same reason as the other providers'
+// ListReleases: latestMatchingRelease needs the full history, not page one.
+func (p *giteaProvider) ListReleases(owner, repo string) ([]*release, error) {
+	path := fmt.Sprintf("%s/repos/%s/%s/releases", p.baseURL, owner, repo)
+	grs, err := paginatePages[giteaRelease](p.get, func(page int) string {
+		return fmt.Sprintf("%s?page=%d&limit=%d", path, page, releasesPerPage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]*release, len(grs))
+	for i := range grs {
+		rs[i] = giteaReleaseToRelease(&grs[i])
+	}
+	return rs, nil
+}
+
+func giteaReleaseToRelease(gr *giteaRelease) *release {
+	assets := make([]releaseAsset, 0, len(gr.Assets))
+	for _, a := range gr.Assets {
+		assets = append(assets, releaseAsset{name: a.Name, browserDownloadURL: a.BrowserDownloadURL})
+	}
+	return &release{tagName: gr.TagName, assets: assets}
+}
+
+func (p *giteaProvider) get(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", p.token))
+	}
+	return doJSONRequest(req, v)
+}
+
+// bitbucketProvider is a releaseProvider backed by the Bitbucket API.
+// Bitbucket has no first-class release concept: the latest tag stands in
+// for a release, and its downloads (shared across all tags) stand in for
+// release assets.
+type bitbucketProvider struct {
+	baseURL string
+	token   string
+}
+
+func newBitbucketProvider(host, token string) *bitbucketProvider {
+	return &bitbucketProvider{baseURL: "https://api.bitbucket.org/2.0", token: token}
+}
+
+type bitbucketTag struct {
+	Name string `json:"name"`
+}
+
+type bitbucketTagPage struct {
+	Values []bitbucketTag `json:"values"`
+	// Next is the full URL of the next page, or "" on the last one -
+	// Bitbucket's own cursor-based pagination, unlike GitLab/Gitea's
+	// page-number query params.
+	Next string `json:"next"`
+}
+
+type bitbucketDownload struct {
+	Name  string `json:"name"`
+	Links struct {
+		Self struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+type bitbucketDownloadPage struct {
+	Values []bitbucketDownload `json:"values"`
+}
+
+func (p *bitbucketProvider) GetLatestRelease(owner, repo string) (*release, error) {
+	var tp bitbucketTagPage
+	path := fmt.Sprintf("%s/repositories/%s/%s/refs/tags?sort=-name", p.baseURL, owner, repo)
+	if err := p.get(path, &tp); err != nil {
+		return nil, err
+	}
+	if len(tp.Values) == 0 {
+		return nil, errors.New("no tags found")
+	}
+	return p.releaseForTag(owner, repo, tp.Values[0].Name)
+}
+
+func (p *bitbucketProvider) GetReleaseByTag(owner, repo, tag string) (*release, error) {
+	return p.releaseForTag(owner, repo, tag)
+}
+
+// ListReleases pages through every tag owner/repo has, following Next until
+// Bitbucket stops returning one, for the same reason the other providers'
+// ListReleases do: latestMatchingRelease needs the full history, not just
+// the first page of tags. Unlike releaseForTag, it fetches the downloads
+// page once and reuses it for every tag instead of refetching per tag -
+// that list is identical for all of them, so an N-tag repo only costs one
+// extra request here, not N.
+func (p *bitbucketProvider) ListReleases(owner, repo string) ([]*release, error) {
+	path := fmt.Sprintf("%s/repositories/%s/%s/refs/tags?sort=-name&pagelen=100", p.baseURL, owner, repo)
+	var tags []bitbucketTag
+	for path != "" {
+		var tp bitbucketTagPage
+		if err := p.get(path, &tp); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tp.Values...)
+		path = tp.Next
+	}
+
+	var dp bitbucketDownloadPage
+	downloadsPath := fmt.Sprintf("%s/repositories/%s/%s/downloads", p.baseURL, owner, repo)
+	if err := p.get(downloadsPath, &dp); err != nil {
+		return nil, err
+	}
+
+	rs := make([]*release, len(tags))
+	for i, t := range tags {
+		rs[i] = bitbucketReleaseToRelease(t.Name, &dp)
+	}
+	return rs, nil
+}
+
+func (p *bitbucketProvider) releaseForTag(owner, repo, tag string) (*release, error) {
+	var dp bitbucketDownloadPage
+	path := fmt.Sprintf("%s/repositories/%s/%s/downloads", p.baseURL, owner, repo)
+	if err := p.get(path, &dp); err != nil {
+		return nil, err
+	}
+	return bitbucketReleaseToRelease(tag, &dp), nil
+}
+
+func bitbucketReleaseToRelease(tag string, dp *bitbucketDownloadPage) *release {
+	assets := make([]releaseAsset, 0, len(dp.Values))
+	for _, d := range dp.Values {
+		assets = append(assets, releaseAsset{name: d.Name, browserDownloadURL: d.Links.Self.Href})
+	}
+	return &release{tagName: tag, assets: assets}
+}
+
+func (p *bitbucketProvider) get(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", p.token))
+	}
+	return doJSONRequest(req, v)
+}
+
+// paginatePages issues GET requests against pageURL(1), pageURL(2), ...
+// via get, decoding each page into a fresh []T and appending it, until a
+// page comes back with fewer than releasesPerPage items - the signal,
+// common to GitLab's and Gitea's page-based list endpoints, that it was
+// the last one.
+func paginatePages[T any](get func(url string, v interface{}) error, pageURL func(page int) string) ([]T, error) {
+	var all []T
+	for page := 1; ; page++ {
+		var items []T
+		if err := get(pageURL(page), &items); err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if len(items) < releasesPerPage {
+			return all, nil
+		}
+	}
+}
+
+func doJSONRequest(req *http.Request, v interface{}) error {
+	req.Header.Set("User-Agent", fmt.Sprintf("maltmill/%s", version))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "request to %s failed", req.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("request to %s failed: status %d", req.URL, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,235 @@
+package maltmill
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// TestGitHubProviderListReleasesPaginates drives githubProvider.ListReleases
+// against a local server speaking go-github's own Link-header pagination,
+// asserting it follows rel="next" instead of stopping at page one -
+// otherwise latestMatchingRelease can't find an older release sitting past
+// the first page.
+func TestGitHubProviderListReleasesPaginates(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			writeJSON(w, []*github.RepositoryRelease{{TagName: github.String("v1.0.0")}})
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?page=2>; rel="next"`, r.URL.Path))
+		writeJSON(w, []*github.RepositoryRelease{{TagName: github.String("v2.0.0")}})
+	}))
+	defer ts.Close()
+
+	p := newGitHubProvider("", "")
+	base, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	p.cli.BaseURL = base
+
+	releases, err := p.ListReleases("owner", "repo")
+	if err != nil {
+		t.Fatalf("ListReleases() error = %v", err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("ListReleases() = %d releases, want 2 (one per page)", len(releases))
+	}
+	if releases[0].tagName != "v2.0.0" || releases[1].tagName != "v1.0.0" {
+		t.Errorf("tagNames = [%s, %s], want [v2.0.0, v1.0.0]", releases[0].tagName, releases[1].tagName)
+	}
+}
+
+// TestGitlabProviderListReleasesPaginates drives gitlabProvider.ListReleases
+// against a server that only hands back the tail release once page two is
+// requested, the same reason as the GitHub test above: a single
+// unpaginated request would silently lose it.
+func TestGitlabProviderListReleasesPaginates(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		if page == "2" {
+			writeJSON(w, []gitlabRelease{{TagName: "v1.0.0"}})
+			return
+		}
+		releases := make([]gitlabRelease, releasesPerPage)
+		for i := range releases {
+			releases[i] = gitlabRelease{TagName: fmt.Sprintf("v2.0.%d", i)}
+		}
+		writeJSON(w, releases)
+	}))
+	defer ts.Close()
+
+	p := &gitlabProvider{baseURL: ts.URL}
+	releases, err := p.ListReleases("owner", "repo")
+	if err != nil {
+		t.Fatalf("ListReleases() error = %v", err)
+	}
+	if len(releases) != releasesPerPage+1 {
+		t.Fatalf("ListReleases() = %d releases, want %d", len(releases), releasesPerPage+1)
+	}
+	if last := releases[len(releases)-1]; last.tagName != "v1.0.0" {
+		t.Errorf("last release = %q, want v1.0.0 (the second page)", last.tagName)
+	}
+}
+
+// TestGiteaProviderListReleasesPaginates is gitlabProvider's pagination
+// test above, against giteaProvider's page/limit query params instead.
+func TestGiteaProviderListReleasesPaginates(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		if page == "2" {
+			writeJSON(w, []giteaRelease{{TagName: "v1.0.0"}})
+			return
+		}
+		releases := make([]giteaRelease, releasesPerPage)
+		for i := range releases {
+			releases[i] = giteaRelease{TagName: fmt.Sprintf("v2.0.%d", i)}
+		}
+		writeJSON(w, releases)
+	}))
+	defer ts.Close()
+
+	p := &giteaProvider{baseURL: ts.URL}
+	releases, err := p.ListReleases("owner", "repo")
+	if err != nil {
+		t.Fatalf("ListReleases() error = %v", err)
+	}
+	if len(releases) != releasesPerPage+1 {
+		t.Fatalf("ListReleases() = %d releases, want %d", len(releases), releasesPerPage+1)
+	}
+	if last := releases[len(releases)-1]; last.tagName != "v1.0.0" {
+		t.Errorf("last release = %q, want v1.0.0 (the second page)", last.tagName)
+	}
+}
+
+// TestBitbucketProviderListReleasesPaginatesAndCachesDownloads drives
+// bitbucketProvider.ListReleases across bitbucket's cursor-style "next" tag
+// pagination, and asserts the downloads endpoint - identical for every tag
+// - is fetched exactly once rather than once per tag.
+func TestBitbucketProviderListReleasesPaginatesAndCachesDownloads(t *testing.T) {
+	var downloadsRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repositories/owner/repo/downloads":
+			downloadsRequests++
+			writeJSON(w, bitbucketDownloadPage{Values: []bitbucketDownload{{Name: "foo.tar.gz"}}})
+		case r.URL.Query().Get("page") == "2":
+			writeJSON(w, bitbucketTagPage{Values: []bitbucketTag{{Name: "v1.0.0"}}})
+		default:
+			writeJSON(w, bitbucketTagPage{
+				Values: []bitbucketTag{{Name: "v2.0.0"}},
+				Next:   requestBaseURL(r) + "?page=2",
+			})
+		}
+	}))
+	defer ts.Close()
+
+	p := &bitbucketProvider{baseURL: ts.URL}
+	releases, err := p.ListReleases("owner", "repo")
+	if err != nil {
+		t.Fatalf("ListReleases() error = %v", err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("ListReleases() = %d releases, want 2 (one per page of tags)", len(releases))
+	}
+	if releases[0].tagName != "v2.0.0" || releases[1].tagName != "v1.0.0" {
+		t.Errorf("tagNames = [%s, %s], want [v2.0.0, v1.0.0]", releases[0].tagName, releases[1].tagName)
+	}
+	if downloadsRequests != 1 {
+		t.Errorf("downloads endpoint requested %d times, want 1 (cached across tags)", downloadsRequests)
+	}
+}
+
+// requestBaseURL rebuilds the scheme+host+path the handler itself was reached at,
+// so the fake "next" link it hands back points at the same test server.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+}
+
+func TestNewReleaseProviderDispatch(t *testing.T) {
+	tests := []struct {
+		host     string
+		wantType string
+	}{
+		{"", "*maltmill.githubProvider"},
+		{"github.com", "*maltmill.githubProvider"},
+		{"gitlab.com", "*maltmill.gitlabProvider"},
+		{"bitbucket.org", "*maltmill.bitbucketProvider"},
+		{"gitea.com", "*maltmill.giteaProvider"},
+		{"gitea.example.com", "*maltmill.giteaProvider"},
+		{"git.example.com", "*maltmill.giteaProvider"},
+	}
+
+	for _, tt := range tests {
+		p := newReleaseProvider(tt.host, "token")
+		if got := fmt.Sprintf("%T", p); got != tt.wantType {
+			t.Errorf("newReleaseProvider(%q) type = %s, want %s", tt.host, got, tt.wantType)
+		}
+	}
+}
+
+func TestGitlabProjectPath(t *testing.T) {
+	if got, want := gitlabProjectPath("owner", "repo"), "owner%2Frepo"; got != want {
+		t.Errorf("gitlabProjectPath() = %q, want %q", got, want)
+	}
+}
+
+func TestGitlabReleaseToRelease(t *testing.T) {
+	var gr gitlabRelease
+	gr.TagName = "v1.0.0"
+	gr.Assets.Links = append(gr.Assets.Links, struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}{Name: "foo.tar.gz", URL: "https://gitlab.example.com/foo.tar.gz"})
+
+	rele := gitlabReleaseToRelease(&gr)
+	if rele.tagName != "v1.0.0" {
+		t.Errorf("tagName = %q, want v1.0.0", rele.tagName)
+	}
+	if len(rele.assets) != 1 || rele.assets[0].name != "foo.tar.gz" || rele.assets[0].browserDownloadURL != "https://gitlab.example.com/foo.tar.gz" {
+		t.Errorf("assets = %+v, want one foo.tar.gz asset", rele.assets)
+	}
+}
+
+func TestGiteaReleaseToRelease(t *testing.T) {
+	gr := &giteaRelease{TagName: "v1.0.0"}
+	gr.Assets = append(gr.Assets, struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	}{Name: "foo.tar.gz", BrowserDownloadURL: "https://gitea.example.com/foo.tar.gz"})
+
+	rele := giteaReleaseToRelease(gr)
+	if rele.tagName != "v1.0.0" {
+		t.Errorf("tagName = %q, want v1.0.0", rele.tagName)
+	}
+	if len(rele.assets) != 1 || rele.assets[0].name != "foo.tar.gz" || rele.assets[0].browserDownloadURL != "https://gitea.example.com/foo.tar.gz" {
+		t.Errorf("assets = %+v, want one foo.tar.gz asset", rele.assets)
+	}
+}
+
+func TestBitbucketReleaseToRelease(t *testing.T) {
+	dp := &bitbucketDownloadPage{Values: []bitbucketDownload{
+		{Name: "foo.tar.gz"},
+	}}
+	dp.Values[0].Links.Self.Href = "https://bitbucket.example.com/foo.tar.gz"
+
+	rele := bitbucketReleaseToRelease("v1.0.0", dp)
+	if rele.tagName != "v1.0.0" {
+		t.Errorf("tagName = %q, want v1.0.0", rele.tagName)
+	}
+	if len(rele.assets) != 1 || rele.assets[0].name != "foo.tar.gz" || rele.assets[0].browserDownloadURL != "https://bitbucket.example.com/foo.tar.gz" {
+		t.Errorf("assets = %+v, want one foo.tar.gz asset", rele.assets)
+	}
+}
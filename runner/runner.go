@@ -0,0 +1,143 @@
+// Package runner loads a Maltmillfile manifest and reconciles every formula
+// it lists: creating the ones that don't exist yet and updating the ones
+// that do, concurrently, and emits a machine-readable report suitable for
+// CI. It turns maltmill from a per-file tool into a batch reconciler over
+// a tap.
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ebc-2in2crc/maltmill"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FormulaEntry describes a single formula the runner is responsible for:
+// where its release lives, and where its formula file should be written.
+type FormulaEntry struct {
+	Slug  string            `yaml:"slug"`
+	Path  string            `yaml:"path"`
+	Auth  map[string]string `yaml:"auth"`
+	Track string            `yaml:"track"`
+	// Matchers overrides the asset-filename matcher maltmill uses to pick a
+	// release asset, keyed "os" or "os_arch" (e.g. "darwin_arm64") and
+	// valued as a regex pattern (e.g. `darwin.*arm64\.tar\.gz`).
+	Matchers map[string]string `yaml:"matchers"`
+	Bottle   string            `yaml:"bottle"`
+}
+
+// Manifest is the parsed form of a Maltmillfile.
+type Manifest struct {
+	Formulae []FormulaEntry `yaml:"formulae"`
+}
+
+// LoadManifest reads and parses the Maltmillfile at path.
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Result is the outcome of reconciling a single FormulaEntry.
+type Result struct {
+	Slug    string `json:"slug"`
+	Path    string `json:"path"`
+	Action  string `json:"action"`
+	Updated bool   `json:"updated"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Report is the aggregate outcome of a Run.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// WriteJSON writes rep as indented JSON to w.
+func (rep *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+// Runner reconciles every formula in a Manifest against its release host.
+type Runner struct {
+	Manifest    *Manifest
+	Concurrency int
+}
+
+// New returns a Runner for manifest with a sane default concurrency.
+func New(manifest *Manifest) *Runner {
+	return &Runner{Manifest: manifest, Concurrency: 4}
+}
+
+// Run creates or updates every formula in r.Manifest, bounding concurrency
+// to r.Concurrency, and aggregates the outcomes into a Report.
+func (r *Runner) Run() *Report {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	sem := make(chan struct{}, concurrency)
+	results := make([]Result, len(r.Manifest.Formulae))
+
+	var wg sync.WaitGroup
+	for i, entry := range r.Manifest.Formulae {
+		wg.Add(1)
+		go func(i int, entry FormulaEntry) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = reconcile(entry)
+		}(i, entry)
+	}
+	wg.Wait()
+
+	return &Report{Results: results}
+}
+
+// reconcile creates entry's formula if its file doesn't exist yet, or
+// updates it in place otherwise.
+func reconcile(entry FormulaEntry) Result {
+	res := Result{Slug: entry.Slug, Path: entry.Path}
+
+	if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+		res.Action = "create"
+		// Render into a buffer first: entry.Path must not exist until
+		// CreateFormula succeeds, or a failed create (bad slug, network
+		// error, no matching asset) leaves an empty stub file behind, and
+		// the next run's os.Stat would then take the "update" branch
+		// instead of retrying "create".
+		var buf bytes.Buffer
+		if err := maltmill.CreateFormula(&buf, entry.Slug, "", entry.Auth, entry.Matchers); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if err := ioutil.WriteFile(entry.Path, buf.Bytes(), 0644); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Updated = true
+		return res
+	}
+
+	res.Action = "update"
+	updated, err := maltmill.UpdateFormula(entry.Path, entry.Auth, entry.Track, entry.Bottle, entry.Matchers)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Updated = updated
+	return res
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testFormulaContent = `class Foo < Formula
+  version '1.0.0'
+  url "https://example.com/owner/repo/foo-1.0.0.tar.gz"
+  sha256 '0000000000000000000000000000000000000000000000000000000000000000'
+end
+`
+
+func TestReconcileCreatesWhenFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	entry := FormulaEntry{Slug: "not-a-valid-slug", Path: path}
+
+	res := reconcile(entry)
+
+	if res.Action != "create" {
+		t.Errorf("Action = %q, want create", res.Action)
+	}
+	if res.Error == "" {
+		t.Error("Error = \"\", want the invalid-slug error from creator.run()")
+	}
+	if res.Updated {
+		t.Error("Updated = true, want false on error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(path) error = %v, want IsNotExist: a failed create must not leave a stub file behind", err)
+	}
+}
+
+func TestReconcileUpdatesWhenFileExists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo.rb")
+	if err := os.WriteFile(path, []byte(testFormulaContent), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	entry := FormulaEntry{Slug: "owner/repo", Path: path, Bottle: "not-a-valid-mode"}
+
+	res := reconcile(entry)
+
+	if res.Action != "update" {
+		t.Errorf("Action = %q, want update", res.Action)
+	}
+	if res.Error == "" {
+		t.Error("Error = \"\", want the invalid-bottle-mode error from setBottleMode()")
+	}
+	if res.Updated {
+		t.Error("Updated = true, want false on error")
+	}
+}
+
+func TestReportWriteJSON(t *testing.T) {
+	rep := &Report{Results: []Result{
+		{Slug: "owner/repo", Path: "repo.rb", Action: "update", Updated: true},
+		{Slug: "owner/other", Path: "other.rb", Action: "create", Error: "boom"},
+	}}
+
+	var buf bytes.Buffer
+	if err := rep.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	var got Report
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v, output:\n%s", err, buf.String())
+	}
+	if len(got.Results) != 2 {
+		t.Fatalf("len(Results) = %d, want 2", len(got.Results))
+	}
+	if got.Results[0] != rep.Results[0] || got.Results[1] != rep.Results[1] {
+		t.Errorf("Results after round-trip = %+v, want %+v", got.Results, rep.Results)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"error"`)) == false {
+		t.Error("JSON missing \"error\" key for the failed result")
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`owner/repo`)) == false {
+		t.Error("JSON missing first result's slug")
+	}
+}
@@ -0,0 +1,82 @@
+package maltmill
+
+import (
+	"regexp"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+)
+
+// trackReg matches a "# maltmill-track: <constraint>" comment, which pins a
+// formula to a semver range (e.g. "^1.2") instead of always tracking the
+// latest release. trackPrereleasesReg opts the same formula into matching
+// prerelease tags, which are otherwise skipped.
+var (
+	trackReg            = regexp.MustCompile(`(?m)^\s*#\s*maltmill-track:\s*(\S+)\s*$`)
+	trackPrereleasesReg = regexp.MustCompile(`(?m)^\s*#\s*maltmill-track-prereleases:\s*true\s*$`)
+)
+
+// parseTrackConstraint extracts the maltmill-track constraint from doc,
+// returning a nil constraint when there is none. Going through doc rather
+// than scanning raw content keeps a heredoc body that merely mentions
+// "maltmill-track" (e.g. a caveats message documenting the formula's own
+// update config) from being mistaken for a real directive.
+func parseTrackConstraint(doc *Document) (*semver.Constraints, error) {
+	s := doc.TrackConstraint()
+	if s == "" {
+		return nil, nil
+	}
+	c, err := semver.NewConstraint(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid maltmill-track constraint: %s", s)
+	}
+	return c, nil
+}
+
+// setTrackConstraint overrides fo's semver constraint (normally parsed from
+// a "# maltmill-track: ..." comment) with one supplied externally, e.g. a
+// Maltmillfile entry's track field.
+func (fo *formula) setTrackConstraint(constraint string) error {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid track constraint: %s", constraint)
+	}
+	fo.constraint = c
+	return nil
+}
+
+// latestMatchingRelease returns the latest release for fo: the newest
+// release satisfying fo.constraint when one is set (skipping prereleases
+// unless fo.trackPrereleases), or simply the latest release otherwise.
+func (fo *formula) latestMatchingRelease(provider releaseProvider) (*release, error) {
+	if fo.constraint == nil {
+		return provider.GetLatestRelease(fo.owner, fo.repo)
+	}
+
+	releases, err := provider.ListReleases(fo.owner, fo.repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *release
+	var bestVer *semver.Version
+	for _, r := range releases {
+		v, err := semver.NewVersion(r.tagName)
+		if err != nil {
+			continue
+		}
+		if !fo.trackPrereleases && v.Prerelease() != "" {
+			continue
+		}
+		if !fo.constraint.Check(v) {
+			continue
+		}
+		if bestVer == nil || bestVer.LessThan(v) {
+			best, bestVer = r, v
+		}
+	}
+	if best == nil {
+		return nil, errors.Errorf("no release of %s/%s matches maltmill-track constraint", fo.owner, fo.repo)
+	}
+	return best, nil
+}
@@ -0,0 +1,168 @@
+package maltmill
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Masterminds/semver"
+)
+
+func TestParseTrackConstraint(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantNil   bool
+		wantErr   bool
+		checkVer  string // if set, asserts the parsed constraint.Check() result for this version
+		wantCheck bool
+	}{
+		{name: "none", content: "class Foo < Formula\nend\n", wantNil: true},
+		{name: "caret", content: "class Foo < Formula\n  # maltmill-track: ^1.2\nend\n", checkVer: "1.5.0", wantCheck: true},
+		{name: "tilde indented", content: "class Foo < Formula\n    #   maltmill-track: ~2.0\nend\n", checkVer: "2.0.5", wantCheck: true},
+		{name: "caret excludes next major", content: "class Foo < Formula\n  # maltmill-track: ^1.2\nend\n", checkVer: "2.0.0", wantCheck: false},
+		{name: "invalid", content: "class Foo < Formula\n  # maltmill-track: not-a-constraint\nend\n", wantErr: true},
+		{
+			name: "mentioned only inside a caveats heredoc is not a real directive",
+			content: "class Foo < Formula\n" +
+				"  def caveats\n" +
+				"    <<~EOS\n" +
+				"      To pin this formula, add a comment like:\n" +
+				"        # maltmill-track: ^9.9\n" +
+				"    EOS\n" +
+				"  end\n" +
+				"end\n",
+			wantNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseDocument(tt.content)
+			if err != nil {
+				t.Fatalf("parseDocument() error = %v", err)
+			}
+			c, err := parseTrackConstraint(doc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrackConstraint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantNil {
+				if c != nil {
+					t.Errorf("constraint = %v, want nil", c)
+				}
+				return
+			}
+			if c == nil {
+				t.Fatal("constraint = nil, want a parsed constraint")
+			}
+			v, err := semver.NewVersion(tt.checkVer)
+			if err != nil {
+				t.Fatalf("semver.NewVersion(%q) error = %v", tt.checkVer, err)
+			}
+			if got := c.Check(v); got != tt.wantCheck {
+				t.Errorf("constraint.Check(%s) = %v, want %v", tt.checkVer, got, tt.wantCheck)
+			}
+		})
+	}
+}
+
+// stubProvider is a releaseProvider backed by a fixed release list, so
+// latestMatchingRelease can be tested without any network access.
+type stubProvider struct {
+	releases []*release
+}
+
+func (p *stubProvider) GetLatestRelease(owner, repo string) (*release, error) {
+	if len(p.releases) == 0 {
+		return nil, errNoReleases
+	}
+	return p.releases[0], nil
+}
+
+func (p *stubProvider) GetReleaseByTag(owner, repo, tag string) (*release, error) {
+	for _, r := range p.releases {
+		if r.tagName == tag {
+			return r, nil
+		}
+	}
+	return nil, errNoReleases
+}
+
+func (p *stubProvider) ListReleases(owner, repo string) ([]*release, error) {
+	return p.releases, nil
+}
+
+var errNoReleases = errors.New("no releases")
+
+func tagReleases(tags ...string) []*release {
+	releases := make([]*release, len(tags))
+	for i, tag := range tags {
+		releases[i] = &release{tagName: tag}
+	}
+	return releases
+}
+
+func TestLatestMatchingReleaseNoConstraint(t *testing.T) {
+	fo := &formula{owner: "foo", repo: "bar"}
+	provider := &stubProvider{releases: tagReleases("v1.0.0")}
+
+	rele, err := fo.latestMatchingRelease(provider)
+	if err != nil {
+		t.Fatalf("latestMatchingRelease() error = %v", err)
+	}
+	if rele.tagName != "v1.0.0" {
+		t.Errorf("tagName = %q, want v1.0.0 (GetLatestRelease, no constraint)", rele.tagName)
+	}
+}
+
+func TestLatestMatchingReleaseSkipsPrereleasesByDefault(t *testing.T) {
+	c, err := semver.NewConstraint(">=1.0.0")
+	if err != nil {
+		t.Fatalf("semver.NewConstraint() error = %v", err)
+	}
+	fo := &formula{owner: "foo", repo: "bar", constraint: c}
+	provider := &stubProvider{releases: tagReleases("2.0.0-rc1", "1.5.0", "1.2.0")}
+
+	rele, err := fo.latestMatchingRelease(provider)
+	if err != nil {
+		t.Fatalf("latestMatchingRelease() error = %v", err)
+	}
+	if rele.tagName != "1.5.0" {
+		t.Errorf("tagName = %q, want 1.5.0 (best non-prerelease match)", rele.tagName)
+	}
+}
+
+func TestLatestMatchingReleaseAllowsPrereleasesWhenOptedIn(t *testing.T) {
+	// The constraint itself must also admit prereleases (">=1.0.0-0" rather
+	// than ">=1.0.0") per semver's own matching rules; trackPrereleases only
+	// controls latestMatchingRelease's own prerelease filter on top of that.
+	c, err := semver.NewConstraint(">=1.0.0-0")
+	if err != nil {
+		t.Fatalf("semver.NewConstraint() error = %v", err)
+	}
+	fo := &formula{owner: "foo", repo: "bar", constraint: c, trackPrereleases: true}
+	provider := &stubProvider{releases: tagReleases("2.0.0-rc1", "1.5.0")}
+
+	rele, err := fo.latestMatchingRelease(provider)
+	if err != nil {
+		t.Fatalf("latestMatchingRelease() error = %v", err)
+	}
+	if rele.tagName != "2.0.0-rc1" {
+		t.Errorf("tagName = %q, want 2.0.0-rc1 (newest, prereleases allowed)", rele.tagName)
+	}
+}
+
+func TestLatestMatchingReleaseNoMatch(t *testing.T) {
+	c, err := semver.NewConstraint("^3.0.0")
+	if err != nil {
+		t.Fatalf("semver.NewConstraint() error = %v", err)
+	}
+	fo := &formula{owner: "foo", repo: "bar", constraint: c}
+	provider := &stubProvider{releases: tagReleases("1.0.0", "2.0.0")}
+
+	if _, err := fo.latestMatchingRelease(provider); err == nil {
+		t.Error("latestMatchingRelease() error = nil, want an error when no release satisfies the constraint")
+	}
+}